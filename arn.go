@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// validRoleArn describes the arns of IAM roles: partition, account id, path and name
+var validRoleArn = regexp.MustCompile(`^arn:(aws|aws-cn|aws-us-gov):iam::(\d{12}):role(/|/[\w+=,.@-]+(?:/[\w+=,.@-]+)*/)([\w+=,.@-]{1,64})$`)
+
+// RoleArn holds the parts of the arn of an IAM role
+type RoleArn struct {
+	Partition string
+	Account   string
+	// Path of the role, "/" or e.g. "/ci/"
+	Path string
+	Name string
+}
+
+// ParseRoleArn splits the arn of an IAM role into its parts, e.g. arn:aws:iam::123456789012:role/ci/deploy
+func ParseRoleArn(arn string) (*RoleArn, error) {
+	parts := validRoleArn.FindStringSubmatch(arn)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid role format")
+	}
+	return &RoleArn{
+		Partition: parts[1],
+		Account:   parts[2],
+		Path:      parts[3],
+		Name:      parts[4],
+	}, nil
+}
+
+// String returns the arn of the role
+func (r *RoleArn) String() string {
+	return fmt.Sprintf("arn:%s:iam::%s:role%s%s", r.Partition, r.Account, r.Path, r.Name)
+}
+
+// validateReaderRoles checks the account ids and arns of the reader roles
+func validateReaderRoles(readerRoles map[string]string) error {
+	for account, role := range readerRoles {
+		if !validAccountID.MatchString(account) {
+			return fmt.Errorf("invalid account id %q", account)
+		}
+		if _, err := ParseRoleArn(role); err != nil {
+			return fmt.Errorf("invalid reader role %q of account %s", role, account)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestParseRoleArn(t *testing.T) {
+	tests := map[string]auth.RoleArn{
+		"arn:aws:iam::012345678910:role/deploy":             {Partition: "aws", Account: "012345678910", Path: "/", Name: "deploy"},
+		"arn:aws:iam::012345678910:role/ci/gitlab/deploy":   {Partition: "aws", Account: "012345678910", Path: "/ci/gitlab/", Name: "deploy"},
+		"arn:aws-cn:iam::012345678910:role/deploy+ci=a,b@c": {Partition: "aws-cn", Account: "012345678910", Path: "/", Name: "deploy+ci=a,b@c"},
+		"arn:aws-us-gov:iam::012345678910:role/deploy.prod": {Partition: "aws-us-gov", Account: "012345678910", Path: "/", Name: "deploy.prod"},
+	}
+	for arn, expected := range tests {
+		t.Run(arn, func(t *testing.T) {
+			role, err := auth.ParseRoleArn(arn)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, *role)
+			assert.Equal(t, arn, role.String())
+		})
+	}
+
+	invalid := []string{
+		"foooo",
+		"arn:aws:iam::0123456789:role/deploy",
+		"arn:aws:iam::012345678910:user/deploy",
+		"arn:aws:sts::012345678910:role/deploy",
+		"arn:aws-xx:iam::012345678910:role/deploy",
+		"arn:aws:iam::012345678910:role/",
+		"arn:aws:iam::012345678910:role//deploy",
+		"arn:aws:iam::012345678910:role/deploy*",
+	}
+	for _, arn := range invalid {
+		t.Run(arn, func(t *testing.T) {
+			_, err := auth.ParseRoleArn(arn)
+			assert.Error(t, err)
+		})
+	}
+}
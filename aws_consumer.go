@@ -4,13 +4,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 // AwsConsumerInterface encapsulates all actions performs with the AWS services
@@ -21,20 +26,43 @@ type AwsConsumerInterface interface {
 	JwksURL() string
 	// Rules holds the globals rules loaded from the S3 bucket
 	Rules() []Rule
-	// AssumeRole performs this for the give rule
-	AssumeRole(ctx context.Context, rule *Rule, name string) (*sts.Credentials, error)
+	// AssumeRole performs this for the give rule and the claims of the token
+	AssumeRole(ctx context.Context, rule *Rule, claims *Claims, requestedDuration int64) (*Credentials, error)
 	// RetrieveRulesFromRoleTags checks whether a string matches the rule format
 	RetrieveRulesFromRoleTags(ctx context.Context, role string) ([]Rule, error)
 	// BoundIssuer holds the global issue configuration
 	BoundIssuer() string
 	// BoundAudience holds the global audience configuration
 	BoundAudience() string
+	// Issuers holds the list of trusted token issuers
+	Issuers() []IssuerConfig
+	// RefreshOptions holds the key set refresh configuration
+	RefreshOptions() RefreshOptions
+	// Introspection holds the token introspection configuration, nil if tokens are validated as JWT
+	Introspection() *IntrospectionConfig
+}
+
+// Credentials are the temporary credentials of an assumed role with the region of the used STS endpoint
+type Credentials struct {
+	*sts.Credentials
+	Region          string `json:"Region,omitempty"`
+	DurationSeconds int64  `json:"DurationSeconds,omitempty"`
 }
 
 // AwsConsumer is the implementation of AwsConsumerInterface
 type AwsConsumer struct {
 	AWS    AwsServiceWrapperInterface
 	Config *Config
+	// maxSessionDurations caches the MaxSessionDuration of all roles retrieved through GetRole by their arn
+	maxSessionDurations sync.Map
+	// reloadHooks are called with the trusted issuers after every successful read of the configuration
+	reloadHooks []func(issuers []IssuerConfig) error
+	// defaults holds the configuration given before the first read, e.g. the environment settings,
+	// every read of the configuration starts from these defaults
+	defaults *Config
+	// accountID caches the account of the Lambda if it is not configured
+	accountID      string
+	accountIDMutex sync.Mutex
 }
 
 // NewAwsConsumer constructs a new consumer with the proper ServiceWrapper
@@ -52,66 +80,344 @@ func NewAwsConsumer(config *Config) (*AwsConsumer, error) {
 	return consumer, nil
 }
 
-// ReadConfiguration reads the configured S3 Bucket and returns Config
+// ReadConfiguration reads the configured S3 Bucket and replaces the Config. The document is read on top
+// of the defaults given before the first read, settings of a previously read document are not kept.
+// The Config is only replaced once the new document is valid and all reload hooks accepted it.
 func (a *AwsConsumer) ReadConfiguration() error {
-	content, err := a.AWS.GetS3Object(a.Config.Bucket, a.Config.ObjectKey)
+	if a.defaults == nil {
+		defaults := *a.Config
+		a.defaults = &defaults
+	}
+	config := a.defaults.clone()
+	content, err := a.AWS.GetS3Object(config.Bucket, config.ObjectKey)
 	if err != nil {
 		return err
 	}
+	defer content.Close()
 	decoder := json.NewDecoder(content)
-	if err := decoder.Decode(a.Config); err != nil {
+	if err := decoder.Decode(config); err != nil {
 		return fmt.Errorf("Unable to read RULES inputClaims.\n Error: %v", err)
 	}
-	log.Debugf("Successfully imported config %v", a.Config)
-	defer content.Close()
+	log.Debugf("Successfully imported config %v", config)
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	for _, warning := range config.ClaimTypeWarnings() {
+		log.Warn(warning)
+	}
+	config.applyDefaults()
+	if err := a.readIssuerKeySets(config); err != nil {
+		return err
+	}
+	for _, hook := range a.reloadHooks {
+		if err := hook(config.IssuerConfigs()); err != nil {
+			return err
+		}
+	}
+	*a.Config = *config
 	return nil
 }
 
+// OnReload registers a function which is called with the trusted issuers whenever the configuration
+// was read, e.g. TokenValidator.Reload to keep static key sets up to date
+func (a *AwsConsumer) OnReload(hook func(issuers []IssuerConfig) error) {
+	a.reloadHooks = append(a.reloadHooks, hook)
+}
+
+// readIssuerKeySets loads the static key sets of all issuers which refer to an S3 object
+func (a *AwsConsumer) readIssuerKeySets(config *Config) error {
+	for i, issuer := range config.Issuers {
+		if issuer.JwksObjectKey == "" {
+			continue
+		}
+		bucket := issuer.JwksBucket
+		if bucket == "" {
+			bucket = config.Bucket
+		}
+		content, err := a.AWS.GetS3Object(bucket, issuer.JwksObjectKey)
+		if err != nil {
+			return fmt.Errorf("unable to read jwks of issuer %q: %w", issuer.Issuer, err)
+		}
+		jwks, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read jwks of issuer %q: %w", issuer.Issuer, err)
+		}
+		config.Issuers[i].Jwks = jwks
+	}
+	return nil
+}
+
+// maxSessionNameLen is the longest role session name STS accepts
+const maxSessionNameLen = 64
+
+// invalidSessionNameChars matches all characters which are not allowed within role session names
+var invalidSessionNameChars = regexp.MustCompile(`[^[:word:]+=,.@-]`)
+
 func (a *AwsConsumer) SessionName(name string) string {
-	invalidChars := regexp.MustCompile(`[^[:word:]+=,.@-]`)
-	name = invalidChars.ReplaceAllLiteralString(name, "")
+	name = invalidSessionNameChars.ReplaceAllLiteralString(name, "")
 
-	if len(name) > 64 {
-		return name[len(name)-64:]
+	if len(name) > maxSessionNameLen {
+		return name[len(name)-maxSessionNameLen:]
 	}
 	return name
 }
 
-// AssumeRole performs this for the give rule
-func (a *AwsConsumer) AssumeRole(ctx context.Context, rule *Rule, name string) (*sts.Credentials, error) {
+// RoleSessionName renders the session_name template of the rule or the configuration, without
+// template or if it can not be rendered the session is named after the subject of the token
+func (a *AwsConsumer) RoleSessionName(ctx context.Context, rule *Rule, claims *Claims) string {
+	source := rule.SessionName
+	if source == "" {
+		source = a.Config.SessionName
+	}
+	if source != "" {
+		name, err := a.renderSessionName(source, claims)
+		if err == nil {
+			return name
+		}
+		Logger(ctx).Warnf("Using the subject as session name: %v", err)
+	}
+	return a.SessionName(claims.RegisteredClaims.Subject)
+}
+
+// renderSessionName renders a session name template with sanitized claim values. Too long names are
+// shortened by cutting the longest claim values from their start, so that short values like ids stay complete.
+func (a *AwsConsumer) renderSessionName(source string, claims *Claims) (string, error) {
+	template, err := ParseTemplate(source)
+	if err != nil {
+		return "", err
+	}
+	segments, err := template.renderSegments(claims.ClaimsJSON, func(value string) (string, error) {
+		return invalidSessionNameChars.ReplaceAllLiteralString(value, ""), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	length := 0
+	for i := range segments {
+		if !segments[i].isClaim {
+			segments[i].text = invalidSessionNameChars.ReplaceAllLiteralString(segments[i].text, "")
+		}
+		length += len(segments[i].text)
+	}
+	for ; length > maxSessionNameLen; length-- {
+		longest := -1
+		for i, segment := range segments {
+			if segment.isClaim && segment.text != "" && (longest < 0 || len(segment.text) > len(segments[longest].text)) {
+				longest = i
+			}
+		}
+		if longest < 0 {
+			break
+		}
+		segments[longest].text = segments[longest].text[1:]
+	}
+	var name strings.Builder
+	for _, segment := range segments {
+		name.WriteString(segment.text)
+	}
+	if name.Len() < 2 {
+		return "", fmt.Errorf("session name %q is too short", name.String())
+	}
+	return a.SessionName(name.String()), nil
+}
+
+// validExternalID describes the characters of external ids accepted by STS
+var validExternalID = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+
+// validateSourceIdentity checks the source identity template and the external id of a rule
+func validateSourceIdentity(rule Rule) error {
+	if rule.SourceIdentity != "" {
+		if _, err := claimValueTemplate(rule.SourceIdentity); err != nil {
+			return fmt.Errorf("invalid source identity: %w", err)
+		}
+	}
+	if rule.ExternalID != "" && (len(rule.ExternalID) < 2 || len(rule.ExternalID) > 1224 || !validExternalID.MatchString(rule.ExternalID)) {
+		return fmt.Errorf("invalid external id")
+	}
+	return nil
+}
+
+// SourceIdentity renders the source identity of the rule from the claims, it is sanitized like
+// session names and has to consist of at least two characters
+func (a *AwsConsumer) SourceIdentity(rule *Rule, claims *Claims) (*string, error) {
+	if rule.SourceIdentity == "" {
+		return nil, nil
+	}
+	template, err := claimValueTemplate(rule.SourceIdentity)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := template.Render(claims.ClaimsJSON, func(value string) (string, error) {
+		return value, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to render source identity: %w", err)
+	}
+	identity := a.SessionName(rendered)
+	if len(identity) < 2 {
+		return nil, fmt.Errorf("source identity %q is too short", identity)
+	}
+	return aws.String(identity), nil
+}
+
+// minSessionDuration is the shortest session STS issues
+const minSessionDuration = 900
+
+// ErrTokenExpiresTooSoon is returned if the session is limited to the token, but the token expires within the shortest session
+var ErrTokenExpiresTooSoon = errors.New("token expires before the shortest possible session")
+
+// SessionDuration returns the duration of the session for the rule. The requested duration (the duration of the rule
+// or configuration if none is requested) is limited by the duration of the rule or configuration, the MaxSessionDuration
+// of the role and optionally the remaining lifetime of the token, but at least 15 minutes. ErrTokenExpiresTooSoon is
+// returned if the session is limited to a token which expires within 15 minutes.
+func (a *AwsConsumer) SessionDuration(rule *Rule, claims *Claims, requestedDuration int64) (int64, error) {
 	duration := rule.Duration
 	if duration == 0 {
 		duration = a.Config.Duration
 	}
-	sessionName := a.SessionName(name)
+	if requestedDuration > 0 && (requestedDuration < duration || duration == 0) {
+		duration = requestedDuration
+	}
+	if maxDuration, ok := a.maxSessionDurations.Load(rule.Role); ok && (duration == 0 || duration > maxDuration.(int64)) {
+		duration = maxDuration.(int64)
+	}
+	if a.Config.LimitDurationToToken && claims.RegisteredClaims != nil && claims.RegisteredClaims.ExpiresAt != nil {
+		remaining := int64(time.Until(claims.RegisteredClaims.ExpiresAt.Time).Seconds())
+		if remaining < minSessionDuration {
+			return 0, fmt.Errorf("%w, %d seconds remaining", ErrTokenExpiresTooSoon, remaining)
+		}
+		if duration == 0 || duration > remaining {
+			duration = remaining
+		}
+	}
+	if duration < minSessionDuration {
+		duration = minSessionDuration
+	}
+	return duration, nil
+}
+
+// AssumeRole performs this for the give rule through the STS endpoint of the region of the rule or configuration,
+// the session is named by RoleSessionName, tagged with the session tags and restricted by the session policies of the rule.
+// Roles with a via chain are assumed through the roles of the chain and last at most one hour.
+func (a *AwsConsumer) AssumeRole(ctx context.Context, rule *Rule, claims *Claims, requestedDuration int64) (*Credentials, error) {
+	duration, err := a.SessionDuration(rule, claims, requestedDuration)
+	if err != nil {
+		return nil, err
+	}
+	region := rule.Region
+	if region == "" {
+		region = a.Config.Region
+	}
+	sessionName := a.RoleSessionName(ctx, rule, claims)
 	roleToAssumeArn := rule.Role
-	result, err := a.AWS.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         &roleToAssumeArn,
-		RoleSessionName: &sessionName,
-		DurationSeconds: &duration,
+	tags, err := sessionTags(rule, claims)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := sessionPolicy(rule, claims)
+	if err != nil {
+		return nil, err
+	}
+	sourceIdentity, err := a.SourceIdentity(rule, claims)
+	if err != nil {
+		return nil, err
+	}
+	var externalID *string
+	if rule.ExternalID != "" {
+		externalID = aws.String(rule.ExternalID)
+	}
+	var transitiveTagKeys []*string
+	if len(rule.TransitiveTagKeys) > 0 {
+		transitiveTagKeys = aws.StringSlice(rule.TransitiveTagKeys)
+	}
+	sourceCredentials, err := a.assumeChain(ctx, rule, region, sessionName, sourceIdentity)
+	if err != nil {
+		return nil, err
+	}
+	if len(rule.Via) > 0 && duration > maxChainedSessionDuration {
+		duration = maxChainedSessionDuration
+	}
+	Logger(ctx).Infof("Assuming role %s as %s", roleToAssumeArn, sessionName)
+	result, err := a.AWS.AssumeRole(region, sourceCredentials, &sts.AssumeRoleInput{
+		RoleArn:           &roleToAssumeArn,
+		RoleSessionName:   &sessionName,
+		DurationSeconds:   &duration,
+		Tags:              tags,
+		TransitiveTagKeys: transitiveTagKeys,
+		Policy:            policy,
+		PolicyArns:        policyArns(rule),
+		SourceIdentity:    sourceIdentity,
+		ExternalId:        externalID,
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to perform sts.AssumeRole: %w", err)
 	}
-	return result.Credentials, nil
+	return &Credentials{Credentials: result.Credentials, Region: region, DurationSeconds: duration}, nil
 }
 
-// RetrieveRulesFromRoleTags checks the IAM role for further rules configured through tags
+// maxChainedSessionDuration is the longest session STS issues for roles assumed with the credentials of another role
+const maxChainedSessionDuration = 3600
+
+// assumeChain assumes the roles of the via chain of the rule in turn, each with the credentials of the previous hop,
+// and returns the credentials of the last hop. Without chain the credentials of the Lambda are used.
+func (a *AwsConsumer) assumeChain(ctx context.Context, rule *Rule, region, sessionName string, sourceIdentity *string) (*sts.Credentials, error) {
+	var sourceCredentials *sts.Credentials
+	for i, hop := range rule.Via {
+		Logger(ctx).Infof("Assuming role %s as %s (hop %d of %d to %s)", hop, sessionName, i+1, len(rule.Via), rule.Role)
+		result, err := a.AWS.AssumeRole(region, sourceCredentials, &sts.AssumeRoleInput{
+			RoleArn:         aws.String(hop),
+			RoleSessionName: aws.String(sessionName),
+			DurationSeconds: aws.Int64(minSessionDuration),
+			SourceIdentity:  sourceIdentity,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to perform sts.AssumeRole for hop %s: %w", hop, err)
+		}
+		sourceCredentials = result.Credentials
+	}
+	return sourceCredentials, nil
+}
+
+// ErrRoleLookupUnavailable is returned if the account of the lambda or the requested role could not be read from AWS
+var ErrRoleLookupUnavailable = errors.New("role lookup is currently unavailable")
+
+// RetrieveRulesFromRoleTags checks the IAM role for further rules configured through tags. Roles of other
+// accounts are read through the reader role of the account, without a reader role they are not read at all.
+// Failures of AWS are returned as ErrRoleLookupUnavailable, a role which does not exist is no such failure.
 func (a *AwsConsumer) RetrieveRulesFromRoleTags(ctx context.Context, roleArn string) ([]Rule, error) {
 	logger := Logger(ctx)
 
-	validRole := regexp.MustCompile(`^arn:aws:iam::\d{12}:role/[a-zA-Z0-9-_]+$`)
-	if !validRole.MatchString(roleArn) {
-		return nil, fmt.Errorf("invalid role format")
+	role, err := ParseRoleArn(roleArn)
+	if err != nil {
+		return nil, err
 	}
 
-	logger.Debugf("GetRole %s", roleArn[31:])
-	result, err := a.AWS.GetRole(&iam.GetRoleInput{
-		RoleName: aws.String(roleArn[31:]),
+	readerRole, ok := a.Config.ReaderRoles[role.Account]
+	if !ok {
+		accountID, err := a.AccountID()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRoleLookupUnavailable, err)
+		}
+		if role.Account != accountID {
+			logger.Debugf("Skipping tags and MaxSessionDuration of %s, no reader role for account %s", roleArn, role.Account)
+			return nil, nil
+		}
+	}
+	logger.Debugf("GetRole %s of account %s through reader role %q", role.Name, role.Account, readerRole)
+	result, err := a.AWS.GetRole(readerRole, &iam.GetRoleInput{
+		RoleName: aws.String(role.Name),
 	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == iam.ErrCodeNoSuchEntityException {
+		return nil, fmt.Errorf("role %s does not exist: %w", roleArn, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: unable to read role %s: %v", ErrRoleLookupUnavailable, roleArn, err)
+	}
+	if result.Role.MaxSessionDuration != nil {
+		a.maxSessionDurations.Store(roleArn, *result.Role.MaxSessionDuration)
 	}
 
 	if !a.Config.RoleAnnotationsEnabled || len(a.Config.RoleAnnotationPrefix) == 0 {
@@ -127,9 +433,15 @@ func (a *AwsConsumer) RetrieveRulesFromRoleTags(ctx context.Context, roleArn str
 		if err != nil {
 			continue
 		}
+		if err := ValidateClaimValues(tagDecoded); err != nil {
+			logger.Warnf("Ignoring invalid rule in tag %s: %v", *tag.Key, err)
+			continue
+		}
+		coerceTypes := a.Config.CoerceTypes
 		rule := Rule{
 			Role:        roleArn,
 			Duration:    a.Config.Duration,
+			CoerceTypes: &coerceTypes,
 			ClaimValues: tagDecoded,
 		}
 		rules = append(rules, rule)
@@ -137,6 +449,24 @@ func (a *AwsConsumer) RetrieveRulesFromRoleTags(ctx context.Context, roleArn str
 	return rules, nil
 }
 
+// AccountID returns the account of the Lambda, either configured through account_id
+// or retrieved once through sts:GetCallerIdentity
+func (a *AwsConsumer) AccountID() (string, error) {
+	if a.Config.AccountID != "" {
+		return a.Config.AccountID, nil
+	}
+	a.accountIDMutex.Lock()
+	defer a.accountIDMutex.Unlock()
+	if a.accountID == "" {
+		identity, err := a.AWS.GetCallerIdentity()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine the account of the lambda: %w", err)
+		}
+		a.accountID = aws.StringValue(identity.Account)
+	}
+	return a.accountID, nil
+}
+
 // Rules returns the list of claim to role configuration rules
 func (a *AwsConsumer) Rules() []Rule {
 	return a.Config.Rules
@@ -154,3 +484,18 @@ func (a *AwsConsumer) BoundIssuer() string {
 func (a *AwsConsumer) BoundAudience() string {
 	return a.Config.BoundAudience
 }
+
+// Issuers returns all trusted issuers from the configuration
+func (a *AwsConsumer) Issuers() []IssuerConfig {
+	return a.Config.IssuerConfigs()
+}
+
+// RefreshOptions forwards the key set refresh settings from the configuration
+func (a *AwsConsumer) RefreshOptions() RefreshOptions {
+	return a.Config.RefreshOptions()
+}
+
+// Introspection forwards the token introspection settings from the configuration
+func (a *AwsConsumer) Introspection() *IntrospectionConfig {
+	return a.Config.Introspection
+}
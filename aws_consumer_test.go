@@ -3,15 +3,19 @@ package auth_test
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"strings"
 	"testing"
+	"time"
 	auth "token_authorizer"
 	"token_authorizer/mock"
 )
@@ -39,6 +43,165 @@ func TestAwsConsumer_ReadConfiguration(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "https://example.org", config.JwksURL)
 	})
+	t.Run("issuer list", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		r := io.NopCloser(strings.NewReader("{\"issuers\": [{\"issuer\": \"https://gitlab.com\", \"jwks_url\": \"https://gitlab.com/-/jwks\"}, {\"issuer\": \"https://token.actions.githubusercontent.com\", \"jwks_url\": \"https://token.actions.githubusercontent.com/.well-known/jwks\", \"bound_audience\": \"sts.amazonaws.com\"}]}"))
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(r, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		err := consumer.ReadConfiguration()
+		assert.NoError(t, err)
+		issuers := consumer.Issuers()
+		assert.Equal(t, 2, len(issuers))
+		assert.Equal(t, "https://gitlab.com", issuers[0].Issuer)
+		assert.Equal(t, "sts.amazonaws.com", issuers[1].BoundAudience)
+	})
+	t.Run("issuer key set from s3", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		r := io.NopCloser(strings.NewReader("{\"issuers\": [{\"issuer\": \"https://gitlab.example.com\", \"jwks_object_key\": \"gitlab-jwks.json\"}]}"))
+		jwks := io.NopCloser(strings.NewReader("{\"keys\": []}"))
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Eq("bucket"), gomock.Eq("key")).Return(r, nil)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Eq("bucket"), gomock.Eq("gitlab-jwks.json")).Return(jwks, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		err := consumer.ReadConfiguration()
+		assert.NoError(t, err)
+		assert.Equal(t, "{\"keys\": []}", string(consumer.Issuers()[0].Jwks))
+	})
+	t.Run("reloads static key sets of the validator", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		privateKey, jwk := newTestKey(t, "key-id")
+		rotatedKey, rotatedJWK := newTestKey(t, "rotated-key-id")
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		var content []io.ReadCloser
+		serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).DoAndReturn(func(bucket, key string) (io.ReadCloser, error) {
+			next := content[0]
+			content = content[1:]
+			return next, nil
+		}).AnyTimes()
+		setContent := func(keys ...JWK) {
+			jwks, _ := json.Marshal(JWKSet{Keys: keys})
+			content = []io.ReadCloser{
+				io.NopCloser(strings.NewReader("{\"issuers\": [{\"issuer\": \"https://gitlab.example.com\", \"jwks_object_key\": \"gitlab-jwks.json\"}]}")),
+				io.NopCloser(strings.NewReader(string(jwks))),
+			}
+		}
+
+		setContent(jwk)
+		assert.NoError(t, consumer.ReadConfiguration())
+		validator, err := auth.NewMultiIssuerTokenValidator(consumer.Issuers(), consumer.RefreshOptions())
+		assert.NoError(t, err)
+		consumer.OnReload(validator.Reload)
+		_, err = validator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.example.com", jwk.Kid, privateKey, nil))
+		assert.NoError(t, err)
+
+		setContent(rotatedJWK)
+		assert.NoError(t, consumer.ReadConfiguration())
+		_, err = validator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.example.com", rotatedJWK.Kid, rotatedKey, nil))
+		assert.NoError(t, err)
+		_, err = validator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.example.com", jwk.Kid, privateKey, nil))
+		assert.Error(t, err)
+	})
+	t.Run("reload drops removed settings", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		gomock.InOrder(
+			serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(io.NopCloser(strings.NewReader("{\"jwks_url\": \"https://example.org\", \"coerce_types\": true, \"rules\": [{\"role\": \"arn:aws:iam::012345678910:role/assume-me\", \"condition\": \"ref == \\\"main\\\"\"}]}")), nil),
+			serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(io.NopCloser(strings.NewReader("{\"rules\": [{\"role\": \"arn:aws:iam::012345678910:role/assume-me\", \"claim_values\": {\"ref\": \"main\"}}]}")), nil),
+		)
+
+		config := &auth.Config{Bucket: "bucket", ObjectKey: "key"}
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: config,
+		}
+		assert.NoError(t, consumer.ReadConfiguration())
+		assert.Equal(t, "https://example.org", consumer.JwksURL())
+		assert.True(t, *consumer.Rules()[0].CoerceTypes)
+
+		assert.NoError(t, consumer.ReadConfiguration())
+		assert.Equal(t, "", consumer.JwksURL())
+		assert.Equal(t, "bucket", config.Bucket)
+		assert.Equal(t, "key", config.ObjectKey)
+		rules := consumer.Rules()
+		assert.Equal(t, 1, len(rules))
+		assert.Equal(t, "", rules[0].Condition)
+		assert.False(t, *rules[0].CoerceTypes)
+	})
+	t.Run("rejected reload keeps the previous configuration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		gomock.InOrder(
+			serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(io.NopCloser(strings.NewReader("{\"jwks_url\": \"https://example.org\", \"rules\": [{\"role\": \"arn:aws:iam::012345678910:role/assume-me\", \"claim_values\": {\"ref\": \"main\"}}]}")), nil),
+			serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(io.NopCloser(strings.NewReader("{\"rules\": [{\"role\": \"arn:aws:iam::012345678910:role/assume-me\", \"claim_values\": {\"ref\": {\"regex\": \"^(release\"}}}]}")), nil),
+		)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		assert.NoError(t, consumer.ReadConfiguration())
+		assert.Error(t, consumer.ReadConfiguration())
+		assert.Equal(t, "https://example.org", consumer.JwksURL())
+		assert.JSONEq(t, "{\"ref\": \"main\"}", string(consumer.Rules()[0].ClaimValues))
+	})
+	t.Run("missing issuer key set", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		r := io.NopCloser(strings.NewReader("{\"issuers\": [{\"issuer\": \"https://gitlab.example.com\", \"jwks_bucket\": \"keys\", \"jwks_object_key\": \"gitlab-jwks.json\"}]}"))
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Eq("bucket"), gomock.Eq("key")).Return(r, nil)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Eq("keys"), gomock.Eq("gitlab-jwks.json")).Return(nil, fmt.Errorf("not found"))
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		err := consumer.ReadConfiguration()
+		assert.Error(t, err)
+	})
+	t.Run("invalid rule pattern", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		r := io.NopCloser(strings.NewReader("{\"rules\": [{\"role\": \"arn:aws:iam::012345678910:role/assume-me\", \"claim_values\": {\"ref\": {\"regex\": \"^(release\"}}}]}"))
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetS3Object(gomock.Any(), gomock.Any()).Return(r, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Bucket: "bucket", ObjectKey: "key"},
+		}
+		err := consumer.ReadConfiguration()
+		assert.Error(t, err)
+	})
 	t.Run("error handling", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -73,14 +236,18 @@ func TestAwsConsumer_ReadConfiguration(t *testing.T) {
 
 func TestAwsConsumer_AssumeRole(t *testing.T) {
 	ctx := context.TODO()
+	claims := &auth.Claims{
+		ClaimsJSON:       []byte("{\"sub\": \"one\", \"project_path\": \"AOEpeople/token auth (main)\", \"project_id\": \"1093\"}"),
+		RegisteredClaims: &jwt.RegisteredClaims{Subject: "one"},
+	}
 
 	t.Run("happy path", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(&sts.AssumeRoleInput{
-			DurationSeconds: aws.Int64(0),
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(900),
 			RoleArn:         aws.String("role:arn"),
 			RoleSessionName: aws.String("one"),
 		})).Return(&sts.AssumeRoleOutput{
@@ -93,17 +260,275 @@ func TestAwsConsumer_AssumeRole(t *testing.T) {
 		}
 		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
 			Role: "role:arn",
-		}, "one")
+		}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", *credentials.AccessKeyId)
+	})
+
+	t.Run("session tags", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(900),
+			RoleArn:         aws.String("role:arn"),
+			RoleSessionName: aws.String("one"),
+			Tags: []*sts.Tag{
+				{Key: aws.String("project"), Value: aws.String("ci-1093")},
+				{Key: aws.String("project_path"), Value: aws.String("AOEpeople/token auth _main_")},
+			},
+			TransitiveTagKeys: aws.StringSlice([]string{"project_path"}),
+		})).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role:              "role:arn",
+			SessionTags:       map[string]string{"project_path": "project_path", "project": "ci-${claims.project_id}"},
+			TransitiveTagKeys: []string{"project_path"},
+		}, claims, 0)
 		assert.NoError(t, err)
 		assert.Equal(t, "key", *credentials.AccessKeyId)
 	})
 
+	t.Run("session tag of missing claim", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		consumer := auth.AwsConsumer{
+			AWS:    mock.NewMockAwsServiceWrapperInterface(ctrl),
+			Config: &auth.Config{},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role:        "role:arn",
+			SessionTags: map[string]string{"pipeline": "pipeline_id"},
+		}, claims, 0)
+		assert.Error(t, err)
+		assert.Nil(t, credentials)
+	})
+
+	t.Run("session policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(900),
+			RoleArn:         aws.String("role:arn"),
+			RoleSessionName: aws.String("one"),
+			Policy:          aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[{\"Effect\":\"Allow\",\"Action\":\"s3:*\",\"Resource\":\"arn:aws:s3:::artifacts/1093/*\"}]}"),
+			PolicyArns:      []*sts.PolicyDescriptorType{{Arn: aws.String("arn:aws:iam::aws:policy/ReadOnlyAccess")}},
+		})).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role: "role:arn",
+			SessionPolicy: []byte(`{
+				"Version": "2012-10-17",
+				"Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "arn:aws:s3:::artifacts/${claims.project_id}/*"}]
+			}`),
+			PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", *credentials.AccessKeyId)
+	})
+
+	t.Run("session policy with policy variables", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(900),
+			RoleArn:         aws.String("role:arn"),
+			RoleSessionName: aws.String("one"),
+			Policy:          aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[{\"Effect\":\"Allow\",\"Action\":\"s3:*\",\"Resource\":\"arn:aws:s3:::artifacts/${aws:PrincipalTag/project}/1093/${aws:username}/*\"}]}"),
+		})).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+
+		rule := auth.Rule{
+			Role: "role:arn",
+			SessionPolicy: []byte(`{
+				"Version": "2012-10-17",
+				"Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "arn:aws:s3:::artifacts/${aws:PrincipalTag/project}/${claims.project_id}/${aws:username}/*"}]
+			}`),
+		}
+		config := &auth.Config{Rules: []auth.Rule{rule}}
+		assert.NoError(t, config.Validate())
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: config,
+		}
+		credentials, err := consumer.AssumeRole(ctx, &rule, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", *credentials.AccessKeyId)
+	})
+
+	t.Run("invalid session policies", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		consumer := auth.AwsConsumer{
+			AWS:    mock.NewMockAwsServiceWrapperInterface(ctrl),
+			Config: &auth.Config{},
+		}
+		wildcardClaims := &auth.Claims{
+			ClaimsJSON:       []byte("{\"project_path\": \"*\"}"),
+			RegisteredClaims: &jwt.RegisteredClaims{Subject: "one"},
+		}
+		policies := map[string]struct {
+			Policy string
+			Claims *auth.Claims
+		}{
+			"01_missing_claim":  {"{\"Resource\": \"${claims.pipeline_id}\"}", claims},
+			"02_wildcard_claim": {"{\"Resource\": \"arn:aws:s3:::artifacts/${claims.project_path}/*\"}", wildcardClaims},
+			"03_invalid_json":   {"{\"Resource\": ${claims.project_path}}", claims},
+			"04_too_large":      {"{\"Sid\": \"" + strings.Repeat("a", 2048) + "\"}", claims},
+		}
+		for name, policy := range policies {
+			t.Run(name, func(t *testing.T) {
+				credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+					Role:          "role:arn",
+					SessionPolicy: []byte(policy.Policy),
+				}, policy.Claims, 0)
+				assert.Error(t, err)
+				assert.Nil(t, credentials)
+			})
+		}
+	})
+
+	t.Run("source identity and external id", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(900),
+			RoleArn:         aws.String("role:arn"),
+			RoleSessionName: aws.String("one"),
+			SourceIdentity:  aws.String("gl-1093"),
+			ExternalId:      aws.String("partner-4711"),
+		})).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role:           "role:arn",
+			SourceIdentity: "gl-${claims.project_id}",
+			ExternalID:     "partner-4711",
+		}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", *credentials.AccessKeyId)
+	})
+
+	t.Run("regional endpoint", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq("eu-central-1"), gomock.Nil(), gomock.Any()).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Eq("eu-west-1"), gomock.Nil(), gomock.Any()).Return(&sts.AssumeRoleOutput{
+			Credentials: &sts.Credentials{AccessKeyId: aws.String("key")},
+		}, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Region: "eu-central-1"},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{Role: "role:arn"}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "eu-central-1", credentials.Region)
+
+		credentials, err = consumer.AssumeRole(ctx, &auth.Rule{Role: "role:arn", Region: "eu-west-1"}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "eu-west-1", credentials.Region)
+	})
+
+	t.Run("role chain", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		brokerCredentials := &sts.Credentials{AccessKeyId: aws.String("broker")}
+		targetBrokerCredentials := &sts.Credentials{AccessKeyId: aws.String("target-broker")}
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		gomock.InOrder(
+			serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Nil(), gomock.Eq(&sts.AssumeRoleInput{
+				DurationSeconds: aws.Int64(900),
+				RoleArn:         aws.String("arn:aws:iam::012345678910:role/broker"),
+				RoleSessionName: aws.String("one"),
+				SourceIdentity:  aws.String("one"),
+			})).Return(&sts.AssumeRoleOutput{Credentials: brokerCredentials}, nil),
+			serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Eq(brokerCredentials), gomock.Eq(&sts.AssumeRoleInput{
+				DurationSeconds: aws.Int64(900),
+				RoleArn:         aws.String("arn:aws:iam::109876543210:role/broker"),
+				RoleSessionName: aws.String("one"),
+				SourceIdentity:  aws.String("one"),
+			})).Return(&sts.AssumeRoleOutput{Credentials: targetBrokerCredentials}, nil),
+			serviceWrapper.EXPECT().AssumeRole(gomock.Eq(""), gomock.Eq(targetBrokerCredentials), gomock.Eq(&sts.AssumeRoleInput{
+				DurationSeconds: aws.Int64(3600),
+				RoleArn:         aws.String("arn:aws:iam::109876543210:role/deploy"),
+				RoleSessionName: aws.String("one"),
+				SourceIdentity:  aws.String("one"),
+			})).Return(&sts.AssumeRoleOutput{Credentials: &sts.Credentials{AccessKeyId: aws.String("key")}}, nil),
+		)
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{Duration: 7200},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role:           "arn:aws:iam::109876543210:role/deploy",
+			Via:            []string{"arn:aws:iam::012345678910:role/broker", "arn:aws:iam::109876543210:role/broker"},
+			SourceIdentity: "sub",
+		}, claims, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "key", *credentials.AccessKeyId)
+		assert.Equal(t, int64(3600), credentials.DurationSeconds)
+	})
+
+	t.Run("role chain error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().AssumeRole(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("access denied"))
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{},
+		}
+		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
+			Role: "arn:aws:iam::109876543210:role/deploy",
+			Via:  []string{"arn:aws:iam::012345678910:role/broker"},
+		}, claims, 0)
+		assert.ErrorContains(t, err, "arn:aws:iam::012345678910:role/broker")
+		assert.Nil(t, credentials)
+	})
+
 	t.Run("error handling", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().AssumeRole(gomock.Any()).Return(nil, fmt.Errorf("mimimi"))
+		serviceWrapper.EXPECT().AssumeRole(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("mimimi"))
 
 		consumer := auth.AwsConsumer{
 			AWS:    serviceWrapper,
@@ -111,7 +536,7 @@ func TestAwsConsumer_AssumeRole(t *testing.T) {
 		}
 		credentials, err := consumer.AssumeRole(ctx, &auth.Rule{
 			Role: "role:arn",
-		}, "one")
+		}, claims, 0)
 		assert.Error(t, err)
 		assert.Nil(t, credentials)
 	})
@@ -137,7 +562,8 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		tags = append(tags, &iam.Tag{Key: aws.String("name"), Value: aws.String("assume-me")})
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().GetRole(gomock.Any()).Return(&iam.GetRoleOutput{
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(&iam.GetRoleOutput{
 			Role: &iam.Role{
 				Tags: tags,
 			},
@@ -157,6 +583,75 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		assert.Equal(t, "arn:aws:iam::012345678910:role/assume-me", credentials[0].Role)
 	})
 
+	t.Run("role of other account without reader role", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil).Times(1)
+
+		consumer := auth.AwsConsumer{
+			AWS: serviceWrapper,
+			Config: &auth.Config{
+				Duration:               3600,
+				RoleAnnotationsEnabled: true,
+				RoleAnnotationPrefix:   "token_auth/",
+			},
+		}
+		role := "arn:aws:iam::109876543210:role/deploy"
+		for i := 0; i < 2; i++ {
+			rules, err := consumer.RetrieveRulesFromRoleTags(ctx, role)
+			assert.NoError(t, err)
+			assert.Empty(t, rules)
+		}
+		duration, err := consumer.SessionDuration(&auth.Rule{Role: role}, &auth.Claims{}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3600), duration)
+	})
+
+	t.Run("unknown account of the lambda", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(nil, fmt.Errorf("no credentials"))
+
+		consumer := auth.AwsConsumer{
+			AWS:    serviceWrapper,
+			Config: &auth.Config{},
+		}
+		rules, err := consumer.RetrieveRulesFromRoleTags(ctx, "arn:aws:iam::109876543210:role/deploy")
+		assert.ErrorIs(t, err, auth.ErrRoleLookupUnavailable)
+		assert.Nil(t, rules)
+	})
+
+	t.Run("role path through reader role", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq("arn:aws:iam::109876543210:role/token-auth-reader"), gomock.Eq(&iam.GetRoleInput{
+			RoleName: aws.String("deploy"),
+		})).Return(&iam.GetRoleOutput{
+			Role: &iam.Role{
+				Tags: []*iam.Tag{{Key: aws.String("token_auth/1"), Value: aws.String(base64.StdEncoding.EncodeToString([]byte("{\"field\":\"valid\"}")))}},
+			},
+		}, nil)
+
+		consumer := auth.AwsConsumer{
+			AWS: serviceWrapper,
+			Config: &auth.Config{
+				RoleAnnotationsEnabled: true,
+				RoleAnnotationPrefix:   "token_auth/",
+				ReaderRoles:            map[string]string{"109876543210": "arn:aws:iam::109876543210:role/token-auth-reader"},
+			},
+		}
+		rules, err := consumer.RetrieveRulesFromRoleTags(ctx, "arn:aws:iam::109876543210:role/ci/deploy")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rules))
+		assert.Equal(t, "arn:aws:iam::109876543210:role/ci/deploy", rules[0].Role)
+	})
+
 	t.Run("disabled role annotations", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -166,7 +661,8 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		tags = append(tags, &iam.Tag{Key: aws.String("name"), Value: aws.String("assume-me")})
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().GetRole(gomock.Any()).Return(&iam.GetRoleOutput{
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(&iam.GetRoleOutput{
 			Role: &iam.Role{
 				Tags: tags,
 			},
@@ -192,7 +688,8 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		tags = append(tags, &iam.Tag{Key: aws.String("name"), Value: aws.String("assume-me")})
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().GetRole(gomock.Any()).Return(&iam.GetRoleOutput{
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(&iam.GetRoleOutput{
 			Role: &iam.Role{
 				Tags: tags,
 			},
@@ -215,14 +712,33 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		defer ctrl.Finish()
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().GetRole(gomock.Any()).Return(nil, fmt.Errorf("not found"))
+		serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(nil, awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil))
 
 		consumer := auth.AwsConsumer{
 			AWS:    serviceWrapper,
-			Config: &auth.Config{},
+			Config: &auth.Config{AccountID: "012345678910"},
 		}
 		credentials, err := consumer.RetrieveRulesFromRoleTags(ctx, "arn:aws:iam::012345678910:role/assume-me")
 		assert.Error(t, err)
+		assert.NotErrorIs(t, err, auth.ErrRoleLookupUnavailable)
+		assert.Empty(t, credentials)
+	})
+
+	t.Run("unreadable role", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq("arn:aws:iam::109876543210:role/token-auth-reader"), gomock.Any()).Return(nil, awserr.New("AccessDenied", "not authorized", nil))
+
+		consumer := auth.AwsConsumer{
+			AWS: serviceWrapper,
+			Config: &auth.Config{
+				ReaderRoles: map[string]string{"109876543210": "arn:aws:iam::109876543210:role/token-auth-reader"},
+			},
+		}
+		credentials, err := consumer.RetrieveRulesFromRoleTags(ctx, "arn:aws:iam::109876543210:role/assume-me")
+		assert.ErrorIs(t, err, auth.ErrRoleLookupUnavailable)
 		assert.Empty(t, credentials)
 	})
 
@@ -234,7 +750,8 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 		tags = append(tags, &iam.Tag{Key: aws.String("token_auth/1"), Value: aws.String("notbase64")})
 
 		serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
-		serviceWrapper.EXPECT().GetRole(gomock.Any()).Return(&iam.GetRoleOutput{
+		serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil)
+		serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(&iam.GetRoleOutput{
 			Role: &iam.Role{
 				Tags: tags,
 			},
@@ -252,6 +769,116 @@ func TestAwsConsumer_RetrieveRulesFromRoleTags(t *testing.T) {
 	})
 }
 
+func TestAwsConsumer_SessionDuration(t *testing.T) {
+	ctx := context.TODO()
+	role := "arn:aws:iam::012345678910:role/assume-me"
+	tests := map[string]struct {
+		RuleDuration         int64
+		ConfigDuration       int64
+		RequestedDuration    int64
+		MaxSessionDuration   int64
+		LimitDurationToToken bool
+		TokenLifetime        time.Duration
+		Duration             int64
+		IsError              bool
+	}{
+		"01_rule_duration":               {RuleDuration: 1800, ConfigDuration: 3600, Duration: 1800},
+		"02_config_duration":             {ConfigDuration: 3600, Duration: 3600},
+		"03_shorter_request":             {ConfigDuration: 3600, RequestedDuration: 1200, Duration: 1200},
+		"04_longer_request":              {ConfigDuration: 3600, RequestedDuration: 7200, Duration: 3600},
+		"05_role_max_session_duration":   {ConfigDuration: 7200, MaxSessionDuration: 3600, Duration: 3600},
+		"06_request_without_rule_limit":  {RequestedDuration: 7200, MaxSessionDuration: 3600, Duration: 3600},
+		"07_token_lifetime":              {ConfigDuration: 3600, LimitDurationToToken: true, Duration: 1199},
+		"08_minimum_duration":            {RequestedDuration: 60, ConfigDuration: 3600, Duration: 900},
+		"09_token_lifetime_not_enforced": {ConfigDuration: 3600, Duration: 3600},
+		"10_token_expires_too_soon":      {ConfigDuration: 3600, LimitDurationToToken: true, TokenLifetime: 10 * time.Minute, IsError: true},
+		"11_token_expired":               {ConfigDuration: 3600, LimitDurationToToken: true, TokenLifetime: -time.Minute, IsError: true},
+		"12_expiring_token_not_enforced": {ConfigDuration: 3600, TokenLifetime: 10 * time.Minute, Duration: 3600},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			consumer := auth.AwsConsumer{
+				Config: &auth.Config{Duration: testCase.ConfigDuration, LimitDurationToToken: testCase.LimitDurationToToken},
+			}
+			if testCase.MaxSessionDuration > 0 {
+				serviceWrapper := mock.NewMockAwsServiceWrapperInterface(ctrl)
+				serviceWrapper.EXPECT().GetCallerIdentity().Return(&sts.GetCallerIdentityOutput{Account: aws.String("012345678910")}, nil)
+				serviceWrapper.EXPECT().GetRole(gomock.Eq(""), gomock.Any()).Return(&iam.GetRoleOutput{
+					Role: &iam.Role{MaxSessionDuration: aws.Int64(testCase.MaxSessionDuration)},
+				}, nil)
+				consumer.AWS = serviceWrapper
+				_, err := consumer.RetrieveRulesFromRoleTags(ctx, role)
+				assert.NoError(t, err)
+			}
+			lifetime := testCase.TokenLifetime
+			if lifetime == 0 {
+				lifetime = 20 * time.Minute
+			}
+			claims := &auth.Claims{RegisteredClaims: &jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(lifetime))}}
+			duration, err := consumer.SessionDuration(&auth.Rule{Role: role, Duration: testCase.RuleDuration}, claims, testCase.RequestedDuration)
+			if testCase.IsError {
+				assert.ErrorIs(t, err, auth.ErrTokenExpiresTooSoon)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, testCase.Duration, duration, 1)
+		})
+	}
+}
+
+func TestAwsConsumer_RoleSessionName(t *testing.T) {
+	ctx := context.TODO()
+	claims := &auth.Claims{
+		ClaimsJSON: []byte("{\"project_id\": \"1093\", \"pipeline_id\": \"1255137\", \"job_id\": \"2769626\", " +
+			"\"project_path\": \"AOEpeople/some-group/with-a-rather/long-project-path-name/which-does-not-fit\"}"),
+		RegisteredClaims: &jwt.RegisteredClaims{Subject: "project_path:AOEpeople/token_auth:ref_type:branch:ref:main"},
+	}
+
+	tests := map[string]struct {
+		RuleSessionName   string
+		ConfigSessionName string
+		SessionName       string
+	}{
+		"01_subject":         {"", "", "project_pathAOEpeopletoken_authref_typebranchrefmain"},
+		"02_rule_template":   {"gl-${project_id}-${pipeline_id}-${job_id}", "gl-${job_id}", "gl-1093-1255137-2769626"},
+		"03_config_template": {"", "gl-${claims.job_id}", "gl-2769626"},
+		"04_sanitized":       {"${project_path}:${job_id}", "", "roupwith-a-ratherlong-project-path-namewhich-does-not-fit2769626"},
+		"05_smart_truncation": {"gl-${project_id}-${project_path}-${job_id}", "",
+			"gl-1093-a-ratherlong-project-path-namewhich-does-not-fit-2769626"},
+		"06_missing_claim": {"gl-${ref}", "", "project_pathAOEpeopletoken_authref_typebranchrefmain"},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			consumer := auth.AwsConsumer{Config: &auth.Config{SessionName: testCase.ConfigSessionName}}
+			sessionName := consumer.RoleSessionName(ctx, &auth.Rule{SessionName: testCase.RuleSessionName}, claims)
+			assert.Equal(t, testCase.SessionName, sessionName)
+			assert.LessOrEqual(t, len(sessionName), 64)
+		})
+	}
+}
+
+func TestAwsConsumer_SourceIdentity(t *testing.T) {
+	consumer := auth.AwsConsumer{}
+	claims := &auth.Claims{ClaimsJSON: []byte("{\"user_login\": \"jane doe\", \"user_id\": \"1\"}")}
+
+	identity, err := consumer.SourceIdentity(&auth.Rule{SourceIdentity: "user_login"}, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "janedoe", *identity)
+
+	identity, err = consumer.SourceIdentity(&auth.Rule{}, claims)
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+
+	_, err = consumer.SourceIdentity(&auth.Rule{SourceIdentity: "user_id"}, claims)
+	assert.Error(t, err)
+
+	_, err = consumer.SourceIdentity(&auth.Rule{SourceIdentity: "pipeline_id"}, claims)
+	assert.Error(t, err)
+}
+
 func TestAwsConsumer_SessionName(t *testing.T) {
 
 	tests := []struct {
@@ -2,24 +2,32 @@ package auth
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"io"
+	"sync"
 )
 
 // AwsServiceWrapperInterface allows to test AWS specific code based on the AWS services
 type AwsServiceWrapperInterface interface {
 	GetS3Object(bucket, key string) (io.ReadCloser, error)
-	AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
-	GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error)
+	AssumeRole(region string, sourceCredentials *sts.Credentials, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
+	GetRole(readerRole string, input *iam.GetRoleInput) (*iam.GetRoleOutput, error)
+	GetCallerIdentity() (*sts.GetCallerIdentityOutput, error)
 }
 
 // AwsServiceWrapper is the implementation of AwsServiceWrapperInterface
 // it wraps the actual AWS service call but has no additional functionality implemented
 type AwsServiceWrapper struct {
-	session *session.Session
+	session    *session.Session
+	mutex      sync.Mutex
+	stsClients map[string]*sts.STS
+	iamClients map[string]*iam.IAM
 }
 
 func (s *AwsServiceWrapper) newSession() (*session.Session, error) {
@@ -48,22 +56,95 @@ func (s *AwsServiceWrapper) GetS3Object(bucket, key string) (io.ReadCloser, erro
 	return resp.Body, nil
 }
 
-// AssumeRole wraps Sts.AssumeRole
-func (s *AwsServiceWrapper) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+// stsConfig returns the configuration of the regional STS endpoint, an empty region uses the default session
+func stsConfig(region string) *aws.Config {
+	config := &aws.Config{}
+	if region != "" {
+		config.Region = aws.String(region)
+		config.STSRegionalEndpoint = endpoints.RegionalSTSEndpoint
+	}
+	return config
+}
+
+// stsClient returns the STS client of the regional endpoint, clients are created once per region
+func (s *AwsServiceWrapper) stsClient(region string) (*sts.STS, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if client, ok := s.stsClients[region]; ok {
+		return client, nil
+	}
 	sess, err := s.newSession()
 	if err != nil {
 		return nil, err
 	}
-	svc := sts.New(sess, &aws.Config{})
+	if s.stsClients == nil {
+		s.stsClients = map[string]*sts.STS{}
+	}
+	s.stsClients[region] = sts.New(sess, stsConfig(region))
+	return s.stsClients[region], nil
+}
+
+// AssumeRole wraps Sts.AssumeRole using the endpoint of the given region. Without source credentials the
+// credentials of the Lambda are used, otherwise these of a previously assumed role to chain roles.
+func (s *AwsServiceWrapper) AssumeRole(region string, sourceCredentials *sts.Credentials, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	if sourceCredentials != nil {
+		sess, err := s.newSession()
+		if err != nil {
+			return nil, err
+		}
+		config := stsConfig(region)
+		config.Credentials = credentials.NewStaticCredentials(
+			aws.StringValue(sourceCredentials.AccessKeyId),
+			aws.StringValue(sourceCredentials.SecretAccessKey),
+			aws.StringValue(sourceCredentials.SessionToken))
+		return sts.New(sess, config).AssumeRole(input)
+	}
+	svc, err := s.stsClient(region)
+	if err != nil {
+		return nil, err
+	}
 	return svc.AssumeRole(input)
 }
 
-// GetRole wraps IAM.GetRole
-func (s *AwsServiceWrapper) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+// iamClient returns the IAM client using the credentials of the reader role, an empty reader role
+// uses the credentials of the default session. Clients are created once per reader role.
+func (s *AwsServiceWrapper) iamClient(readerRole string) (*iam.IAM, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if client, ok := s.iamClients[readerRole]; ok {
+		return client, nil
+	}
 	sess, err := s.newSession()
 	if err != nil {
 		return nil, err
 	}
-	svc := iam.New(sess)
+	config := &aws.Config{}
+	if readerRole != "" {
+		config.Credentials = stscreds.NewCredentials(sess, readerRole)
+	}
+	if s.iamClients == nil {
+		s.iamClients = map[string]*iam.IAM{}
+	}
+	s.iamClients[readerRole] = iam.New(sess, config)
+	return s.iamClients[readerRole], nil
+}
+
+// GetRole wraps IAM.GetRole, roles of other accounts are read by assuming the reader role of the account
+func (s *AwsServiceWrapper) GetRole(readerRole string, input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	svc, err := s.iamClient(readerRole)
+	if err != nil {
+		return nil, err
+	}
 	return svc.GetRole(input)
 }
+
+// GetCallerIdentity wraps Sts.GetCallerIdentity of the default endpoint, it returns the account of the Lambda
+func (s *AwsServiceWrapper) GetCallerIdentity() (*sts.GetCallerIdentityOutput, error) {
+	svc, err := s.stsClient("")
+	if err != nil {
+		return nil, err
+	}
+	return svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+}
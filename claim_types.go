@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/buger/jsonparser"
+	"sort"
+	"strings"
+)
+
+// Claim types as named in IssuerConfig.ClaimTypes
+const (
+	ClaimTypeString  = "string"
+	ClaimTypeNumber  = "number"
+	ClaimTypeBoolean = "boolean"
+)
+
+// registeredClaimTypes holds the types of the registered claims every issuer sends
+var registeredClaimTypes = map[string]string{
+	"exp": ClaimTypeNumber,
+	"nbf": ClaimTypeNumber,
+	"iat": ClaimTypeNumber,
+	"iss": ClaimTypeString,
+	"sub": ClaimTypeString,
+	"jti": ClaimTypeString,
+}
+
+// knownClaimTypes holds the types of claims sent by well known issuers, ids are sent as strings
+var knownClaimTypes = map[string]map[string]string{
+	"gitlab": {
+		"namespace_id":          ClaimTypeString,
+		"namespace_path":        ClaimTypeString,
+		"project_id":            ClaimTypeString,
+		"project_path":          ClaimTypeString,
+		"user_id":               ClaimTypeString,
+		"user_login":            ClaimTypeString,
+		"user_email":            ClaimTypeString,
+		"pipeline_id":           ClaimTypeString,
+		"pipeline_source":       ClaimTypeString,
+		"job_id":                ClaimTypeString,
+		"ref":                   ClaimTypeString,
+		"ref_type":              ClaimTypeString,
+		"ref_protected":         ClaimTypeString,
+		"environment":           ClaimTypeString,
+		"environment_protected": ClaimTypeString,
+		"deployment_tier":       ClaimTypeString,
+		"runner_id":             ClaimTypeNumber,
+		"runner_environment":    ClaimTypeString,
+	},
+	"github": {
+		"repository":          ClaimTypeString,
+		"repository_id":       ClaimTypeString,
+		"repository_owner":    ClaimTypeString,
+		"repository_owner_id": ClaimTypeString,
+		"actor":               ClaimTypeString,
+		"actor_id":            ClaimTypeString,
+		"run_id":              ClaimTypeString,
+		"run_number":          ClaimTypeString,
+		"run_attempt":         ClaimTypeString,
+		"ref":                 ClaimTypeString,
+		"ref_type":            ClaimTypeString,
+		"environment":         ClaimTypeString,
+		"workflow":            ClaimTypeString,
+		"event_name":          ClaimTypeString,
+	},
+}
+
+// IssuerFlavor returns the kind of well known issuer, either the configured flavor
+// or one derived from the issuer url
+func (i *IssuerConfig) IssuerFlavor() string {
+	if i.Flavor != "" {
+		return i.Flavor
+	}
+	switch {
+	case i.Issuer == "https://token.actions.githubusercontent.com":
+		return "github"
+	case strings.Contains(i.Issuer, "gitlab"):
+		return "gitlab"
+	}
+	return ""
+}
+
+// ClaimTypes returns the known types of the claims sent by the issuer
+func (i *IssuerConfig) ClaimTypes() map[string]string {
+	types := map[string]string{}
+	for claim, claimType := range registeredClaimTypes {
+		types[claim] = claimType
+	}
+	for claim, claimType := range knownClaimTypes[i.IssuerFlavor()] {
+		types[claim] = claimType
+	}
+	for claim, claimType := range i.KnownClaimTypes {
+		types[claim] = claimType
+	}
+	return types
+}
+
+// validateClaimTypes checks the flavor and the configured claim types of the issuer
+func (i *IssuerConfig) validateClaimTypes() error {
+	if _, ok := knownClaimTypes[i.Flavor]; i.Flavor != "" && !ok {
+		return fmt.Errorf("unknown flavor %q", i.Flavor)
+	}
+	for claim, claimType := range i.KnownClaimTypes {
+		if claimType != ClaimTypeString && claimType != ClaimTypeNumber && claimType != ClaimTypeBoolean {
+			return fmt.Errorf("invalid type %q of claim %s", claimType, claim)
+		}
+	}
+	return nil
+}
+
+// ClaimTypeWarnings lists rules comparing claims with literals of another type than the one
+// sent by the issuers. These rules never match unless coerce_types is enabled.
+func (c *Config) ClaimTypeWarnings() []string {
+	var warnings []string
+	for _, issuer := range c.IssuerConfigs() {
+		types := issuer.ClaimTypes()
+		for i, rule := range c.Rules {
+			if rule.MatchOptions().CoerceTypes || (rule.CoerceTypes == nil && c.CoerceTypes) {
+				continue
+			}
+			for _, claim := range mismatchedClaims(rule.ClaimValues, types) {
+				warnings = append(warnings, fmt.Sprintf("rule %d (%s) compares claim %s with a literal which is no %s as sent by issuer %q",
+					i, rule.Role, claim, types[claim], issuer.Issuer))
+			}
+		}
+	}
+	return warnings
+}
+
+// mismatchedClaims returns the top level claims of the claim values with scalar literals
+// of another type than the known type of the claim
+func mismatchedClaims(claimValues []byte, types map[string]string) []string {
+	var claims []string
+	_ = jsonparser.ObjectEach(claimValues, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		claim := string(key)
+		claimType, ok := types[claim]
+		if !ok {
+			return nil
+		}
+		mismatch := !literalHasType(dataType, claimType)
+		if dataType == jsonparser.Array {
+			mismatch = false
+			_, _ = jsonparser.ArrayEach(value, func(element []byte, elementType jsonparser.ValueType, offset int, err error) {
+				mismatch = mismatch || !literalHasType(elementType, claimType)
+			})
+		}
+		if mismatch {
+			claims = append(claims, claim)
+		}
+		return nil
+	})
+	sort.Strings(claims)
+	return claims
+}
+
+// literalHasType checks a scalar literal against a claim type, operator objects and nested
+// values are not checked
+func literalHasType(dataType jsonparser.ValueType, claimType string) bool {
+	switch dataType {
+	case jsonparser.String:
+		return claimType == ClaimTypeString
+	case jsonparser.Number:
+		return claimType == ClaimTypeNumber
+	case jsonparser.Boolean:
+		return claimType == ClaimTypeBoolean
+	}
+	return true
+}
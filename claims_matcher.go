@@ -0,0 +1,644 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MatchOptions configures how claims are compared with rules
+type MatchOptions struct {
+	// CoerceTypes compares numbers, booleans and strings by their value, e.g. 4 matches "4"
+	CoerceTypes bool
+}
+
+// ErrAccessDenied is returned if the claims of a token match a deny rule
+var ErrAccessDenied = errors.New("access denied")
+
+// claimOperator compares a claim value with the operand of a rule operator
+type claimOperator func(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operand []byte, operandType jsonparser.ValueType) (bool, error)
+
+// claimOperators holds all operators which can be used as object keys within claim_values,
+// e.g. {"groups": {"contains_all": ["developers", "deployers"]}}
+var claimOperators map[string]claimOperator
+
+func init() {
+	claimOperators = map[string]claimOperator{
+		"contains_all": matchContainsAll,
+		"glob":         matchPattern(globPattern),
+		"regex":        matchPattern(regexPattern),
+		"gt":           matchComparison(func(comparison int) bool { return comparison > 0 }),
+		"gte":          matchComparison(func(comparison int) bool { return comparison >= 0 }),
+		"lt":           matchComparison(func(comparison int) bool { return comparison < 0 }),
+		"lte":          matchComparison(func(comparison int) bool { return comparison <= 0 }),
+		"between":      matchBetween,
+	}
+}
+
+// MatchClaimsInternal implements claims matching on the json byte data level
+//
+// Scalar rule values have to be equal to the claim value, or be contained in it if the claim is an array.
+// Array rule values list alternatives, one of them has to match. Objects either match nested claims
+// or, if all keys are operators, compare the claim through these operators.
+func MatchClaimsInternal(ctx context.Context, claims []byte, rules []byte) (bool, error) {
+	return MatchClaimsWithOptions(ctx, claims, rules, MatchOptions{})
+}
+
+// MatchClaimsWithOptions implements claims matching like MatchClaimsInternal with the given options
+func MatchClaimsWithOptions(ctx context.Context, claims []byte, rules []byte, options MatchOptions) (bool, error) {
+	matches := true
+
+	err := jsonparser.ObjectEach(rules, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		keyString := string(key)
+
+		claimsObj, claimsObjDataType, _, err := jsonparser.Get(claims, keyString)
+		//Check for parsing errors
+		if err != nil && claimsObjDataType != jsonparser.NotExist {
+			return err
+		}
+
+		valueMatches, err := matchClaimValue(ctx, options, claimsObj, claimsObjDataType, value, dataType)
+		if err != nil {
+			return err
+		}
+		if !valueMatches {
+			matches = false
+		}
+		return nil
+	})
+	return matches && err == nil, err
+}
+
+// matchClaimValue compares a single claim value with a rule value
+func matchClaimValue(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, rule []byte, ruleType jsonparser.ValueType) (bool, error) {
+	switch ruleType {
+	case jsonparser.Object:
+		operators, err := ruleOperators(rule)
+		if err != nil {
+			return false, err
+		}
+		if len(operators) > 0 {
+			return matchOperators(ctx, options, claim, claimType, operators)
+		}
+		//Check if object matches with rules
+		if claimType != jsonparser.Object {
+			return false, nil
+		}
+		return MatchClaimsWithOptions(ctx, claim, rule, options)
+	case jsonparser.Array:
+		return matchAnyOf(ctx, options, claim, claimType, rule)
+	case jsonparser.String, jsonparser.Boolean, jsonparser.Number:
+		if claimType == jsonparser.Array {
+			return arrayContains(ctx, options, claim, rule, ruleType)
+		}
+		if options.CoerceTypes {
+			return coercedEqual(claim, claimType, rule, ruleType), nil
+		}
+		return claimType == ruleType && bytes.Equal(claim, rule), nil
+	default:
+		return false, fmt.Errorf("iterated over a key with type %s. This should not happen", ruleType.String())
+	}
+}
+
+// coercedEqual compares two scalar values of different types by their value, a number equals a string
+// holding the same number and a boolean equals the string "true" or "false". Values of the same type
+// are compared strictly.
+func coercedEqual(claim []byte, claimType jsonparser.ValueType, rule []byte, ruleType jsonparser.ValueType) bool {
+	if claimType == ruleType {
+		return bytes.Equal(claim, rule)
+	}
+	value, valueType, quoted := claim, claimType, rule
+	if claimType == jsonparser.String {
+		value, valueType, quoted = rule, ruleType, claim
+	} else if ruleType != jsonparser.String {
+		return false
+	}
+	text, err := jsonparser.ParseString(quoted)
+	if err != nil {
+		return false
+	}
+	switch valueType {
+	case jsonparser.Boolean:
+		return text == string(value)
+	case jsonparser.Number:
+		if !jsonNumber.MatchString(text) {
+			return false
+		}
+		number, ok := parseDecimal(string(value))
+		if !ok {
+			return false
+		}
+		textNumber, ok := parseDecimal(text)
+		return ok && number.Cmp(textNumber) == 0
+	}
+	return false
+}
+
+// jsonNumber describes strings which are coerced to numbers, these are written like JSON numbers
+// without leading zeros, e.g. "4" or "1.5"
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9]\d*)(\.\d+)?([eE][+-]?\d{1,3})?$`)
+
+// matchAnyOf checks whether one of the alternatives of the rule array matches the claim
+func matchAnyOf(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, rule []byte) (bool, error) {
+	matches := false
+	var matchErr error
+	_, err := jsonparser.ArrayEach(rule, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if matches || matchErr != nil {
+			return
+		}
+		if err != nil {
+			matchErr = err
+			return
+		}
+		matches, matchErr = matchClaimValue(ctx, options, claim, claimType, value, dataType)
+	})
+	if err != nil {
+		return false, err
+	}
+	return matches && matchErr == nil, matchErr
+}
+
+// arrayContains checks whether one element of the claim array matches the rule value
+func arrayContains(ctx context.Context, options MatchOptions, claim []byte, rule []byte, ruleType jsonparser.ValueType) (bool, error) {
+	contains := false
+	var matchErr error
+	_, err := jsonparser.ArrayEach(claim, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if contains || matchErr != nil {
+			return
+		}
+		if err != nil {
+			matchErr = err
+			return
+		}
+		contains, matchErr = matchClaimValue(ctx, options, value, dataType, rule, ruleType)
+	})
+	if err != nil {
+		return false, err
+	}
+	return contains && matchErr == nil, matchErr
+}
+
+// ruleOperator is a single operator with its operand
+type ruleOperator struct {
+	name        string
+	operand     []byte
+	operandType jsonparser.ValueType
+}
+
+// ruleOperators returns the operators of a rule object, or nothing if one of its keys is no operator
+func ruleOperators(rule []byte) ([]ruleOperator, error) {
+	var operators []ruleOperator
+	isOperatorObject := true
+	err := jsonparser.ObjectEach(rule, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		name := string(key)
+		if _, ok := claimOperators[name]; !ok {
+			isOperatorObject = false
+		}
+		operators = append(operators, ruleOperator{name: name, operand: value, operandType: dataType})
+		return nil
+	})
+	if err != nil || !isOperatorObject {
+		return nil, err
+	}
+	return operators, nil
+}
+
+// matchOperators checks whether the claim satisfies all operators
+func matchOperators(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operators []ruleOperator) (bool, error) {
+	for _, operator := range operators {
+		matches, err := claimOperators[operator.name](ctx, options, claim, claimType, operator.operand, operator.operandType)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchContainsAll checks whether the claim array contains every value of the operand array
+func matchContainsAll(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operand []byte, operandType jsonparser.ValueType) (bool, error) {
+	if operandType != jsonparser.Array {
+		return false, fmt.Errorf("contains_all expects an array")
+	}
+	if claimType == jsonparser.NotExist {
+		return false, nil
+	}
+	matches := true
+	var matchErr error
+	_, err := jsonparser.ArrayEach(operand, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if !matches || matchErr != nil {
+			return
+		}
+		if err != nil {
+			matchErr = err
+			return
+		}
+		matches, matchErr = matchClaimValue(ctx, options, claim, claimType, value, dataType)
+	})
+	if err != nil {
+		return false, err
+	}
+	return matches && matchErr == nil, matchErr
+}
+
+// patternKind translates a pattern into a regular expression
+type patternKind func(pattern string) string
+
+// regexPattern uses the pattern as regular expression as it is
+func regexPattern(pattern string) string {
+	return pattern
+}
+
+// globPattern translates a glob into an anchored regular expression: "*" matches
+// any characters except "/", "**" also matches "/" and "?" matches a single character
+func globPattern(pattern string) string {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expression.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expression.WriteString("$")
+	return expression.String()
+}
+
+// patternCache holds all compiled regular expressions by their expression
+var patternCache sync.Map
+
+// compilePattern returns the compiled regular expression of the pattern, every pattern is only compiled once
+func compilePattern(kind patternKind, pattern string) (*regexp.Regexp, error) {
+	expression := kind(pattern)
+	if compiled, ok := patternCache.Load(expression); ok {
+		return compiled.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	patternCache.Store(expression, compiled)
+	return compiled, nil
+}
+
+// matchPattern creates an operator matching string claims, or any element of array claims, against a pattern
+func matchPattern(kind patternKind) claimOperator {
+	return func(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operand []byte, operandType jsonparser.ValueType) (bool, error) {
+		if operandType != jsonparser.String {
+			return false, fmt.Errorf("pattern operators expect a string")
+		}
+		pattern, err := jsonparser.ParseString(operand)
+		if err != nil {
+			return false, err
+		}
+		compiled, err := compilePattern(kind, pattern)
+		if err != nil {
+			return false, err
+		}
+		return matchStrings(claim, claimType, compiled.MatchString)
+	}
+}
+
+// matchStrings applies the check to a string claim, or to every element of an array claim until one matches
+func matchStrings(claim []byte, claimType jsonparser.ValueType, check func(value string) bool) (bool, error) {
+	switch claimType {
+	case jsonparser.String:
+		value, err := jsonparser.ParseString(claim)
+		if err != nil {
+			return false, err
+		}
+		return check(value), nil
+	case jsonparser.Array:
+		matches := false
+		var matchErr error
+		_, err := jsonparser.ArrayEach(claim, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			if matches || matchErr != nil {
+				return
+			}
+			if err != nil {
+				matchErr = err
+				return
+			}
+			matches, matchErr = matchStrings(value, dataType, check)
+		})
+		if err != nil {
+			return false, err
+		}
+		return matches && matchErr == nil, matchErr
+	default:
+		return false, nil
+	}
+}
+
+// decimalNumber describes the numbers accepted within numeric strings, the exponent is limited
+// to keep exact comparisons cheap. Non-finite values like "Infinity" or "NaN" are no numbers.
+var decimalNumber = regexp.MustCompile(`^-?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d{1,3})?$`)
+
+// parseDecimal parses a decimal number exactly, large integer ids are not rounded
+func parseDecimal(text string) (*big.Rat, bool) {
+	if !decimalNumber.MatchString(text) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(text)
+}
+
+// numericValue parses numbers, numeric strings and RFC 3339 timestamps, which are
+// returned as epoch seconds to allow comparisons with time claims like iat
+func numericValue(value []byte, dataType jsonparser.ValueType) (*big.Rat, bool) {
+	switch dataType {
+	case jsonparser.Number:
+		return parseDecimal(string(value))
+	case jsonparser.String:
+		text, err := jsonparser.ParseString(value)
+		if err != nil {
+			return nil, false
+		}
+		if number, ok := parseDecimal(strings.TrimSpace(text)); ok {
+			return number, true
+		}
+		if timestamp, err := time.Parse(time.RFC3339, text); err == nil {
+			return new(big.Rat).SetInt64(timestamp.Unix()), true
+		}
+	}
+	return nil, false
+}
+
+// matchNumbers applies the check to a numeric claim, or to every element of an array claim until one matches
+func matchNumbers(claim []byte, claimType jsonparser.ValueType, check func(value *big.Rat) bool) (bool, error) {
+	if claimType == jsonparser.Array {
+		matches := false
+		_, err := jsonparser.ArrayEach(claim, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			if !matches && err == nil {
+				matches, _ = matchNumbers(value, dataType, check)
+			}
+		})
+		return matches && err == nil, err
+	}
+	number, ok := numericValue(claim, claimType)
+	return ok && check(number), nil
+}
+
+// matchComparison creates an operator comparing numeric claims with a numeric operand,
+// the check receives the result of comparing the claim with the operand (-1, 0 or +1)
+func matchComparison(check func(comparison int) bool) claimOperator {
+	return func(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operand []byte, operandType jsonparser.ValueType) (bool, error) {
+		limit, ok := numericValue(operand, operandType)
+		if !ok {
+			return false, fmt.Errorf("comparison operators expect a number or timestamp")
+		}
+		return matchNumbers(claim, claimType, func(value *big.Rat) bool {
+			return check(value.Cmp(limit))
+		})
+	}
+}
+
+// matchBetween checks whether a numeric claim lies within the inclusive [lower, upper] operand
+func matchBetween(ctx context.Context, options MatchOptions, claim []byte, claimType jsonparser.ValueType, operand []byte, operandType jsonparser.ValueType) (bool, error) {
+	lower, upper, err := betweenLimits(operand, operandType)
+	if err != nil {
+		return false, err
+	}
+	return matchNumbers(claim, claimType, func(value *big.Rat) bool {
+		return value.Cmp(lower) >= 0 && value.Cmp(upper) <= 0
+	})
+}
+
+// betweenLimits parses the [lower, upper] operand of the between operator
+func betweenLimits(operand []byte, operandType jsonparser.ValueType) (*big.Rat, *big.Rat, error) {
+	if operandType != jsonparser.Array {
+		return nil, nil, fmt.Errorf("between expects an array of two numbers or timestamps")
+	}
+	var limits []*big.Rat
+	valid := true
+	_, err := jsonparser.ArrayEach(operand, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		limit, ok := numericValue(value, dataType)
+		valid = valid && ok && err == nil
+		limits = append(limits, limit)
+	})
+	if err != nil || !valid || len(limits) != 2 {
+		return nil, nil, fmt.Errorf("between expects an array of two numbers or timestamps")
+	}
+	if limits[0].Cmp(limits[1]) > 0 {
+		return nil, nil, fmt.Errorf("between expects the lower limit first")
+	}
+	return limits[0], limits[1], nil
+}
+
+// ValidateClaimValues checks the operators within claim values and compiles all patterns,
+// it is meant to be used while loading the configuration
+func ValidateClaimValues(claimValues []byte) error {
+	if len(claimValues) == 0 {
+		return nil
+	}
+	return jsonparser.ObjectEach(claimValues, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		if err := validateClaimValue(value, dataType); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// validateClaimValue checks a single rule value and all values nested within
+func validateClaimValue(value []byte, dataType jsonparser.ValueType) error {
+	switch dataType {
+	case jsonparser.Object:
+		operators, err := ruleOperators(value)
+		if err != nil {
+			return err
+		}
+		for _, operator := range operators {
+			if err := validateOperator(operator); err != nil {
+				return err
+			}
+		}
+		if len(operators) == 0 {
+			return ValidateClaimValues(value)
+		}
+	case jsonparser.Array:
+		var validationErr error
+		_, err := jsonparser.ArrayEach(value, func(element []byte, elementType jsonparser.ValueType, offset int, err error) {
+			if validationErr == nil {
+				validationErr = validateClaimValue(element, elementType)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return validationErr
+	case jsonparser.String, jsonparser.Boolean, jsonparser.Number:
+	default:
+		return fmt.Errorf("unsupported value type %s", dataType.String())
+	}
+	return nil
+}
+
+// validateOperator checks the operand of an operator
+func validateOperator(operator ruleOperator) error {
+	switch operator.name {
+	case "contains_all":
+		if operator.operandType != jsonparser.Array {
+			return fmt.Errorf("contains_all expects an array")
+		}
+		return validateClaimValue(operator.operand, operator.operandType)
+	case "glob", "regex":
+		if operator.operandType != jsonparser.String {
+			return fmt.Errorf("%s expects a string", operator.name)
+		}
+		pattern, err := jsonparser.ParseString(operator.operand)
+		if err != nil {
+			return err
+		}
+		kind := regexPattern
+		if operator.name == "glob" {
+			kind = globPattern
+		}
+		_, err = compilePattern(kind, pattern)
+		return err
+	case "gt", "gte", "lt", "lte":
+		if _, ok := numericValue(operator.operand, operator.operandType); !ok {
+			return fmt.Errorf("%s expects a number or timestamp", operator.name)
+		}
+	case "between":
+		_, _, err := betweenLimits(operator.operand, operator.operandType)
+		return err
+	}
+	return nil
+}
+
+// ClaimsMatcher implements the rule matching part of TokenValidatorInterface,
+// it is shared by all validators independent of how the claims were retrieved
+type ClaimsMatcher struct{}
+
+// MatchClaims check if all claims from a token are presented within rules
+func (t *ClaimsMatcher) MatchClaims(ctx context.Context, tokenClaims *Claims, ruleClaims []byte) bool {
+	Logger(ctx).Debugf("Rules JSON: %s", ruleClaims)
+	match, err := MatchClaimsInternal(ctx, tokenClaims.ClaimsJSON, ruleClaims)
+	if err != nil {
+		Logger(ctx).Warnf("error matching claims: %s", err)
+	}
+	return match && err == nil
+}
+
+// matchRule checks the claims against the claim values of the rule using the match options of the rule
+// and evaluates the condition of the rule. Rules with a condition may omit the claim values, deny rules
+// without claim values and condition match every token.
+func (t *ClaimsMatcher) matchRule(ctx context.Context, tokenClaims *Claims, rule *Rule) (bool, error) {
+	if len(rule.ClaimValues) == 0 && rule.Condition == "" {
+		return rule.IsDeny(), nil
+	}
+	if len(rule.ClaimValues) > 0 {
+		Logger(ctx).Debugf("Rules JSON: %s", rule.ClaimValues)
+		match, err := MatchClaimsWithOptions(ctx, tokenClaims.ClaimsJSON, rule.ClaimValues, rule.MatchOptions())
+		if err != nil {
+			return false, fmt.Errorf("error matching claims: %w", err)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	if rule.Condition == "" {
+		return true, nil
+	}
+	condition, err := ParseCondition(rule.Condition)
+	if err != nil {
+		return false, fmt.Errorf("error parsing condition: %w", err)
+	}
+	match, err := condition.Evaluate(tokenClaims.ClaimsJSON)
+	if err != nil {
+		return false, fmt.Errorf("error evaluating condition: %w", err)
+	}
+	return match, nil
+}
+
+// matchRole checks whether the requested role is the role of the rule, or matches its role pattern.
+// Role templates are rendered from the claims of the token first.
+func (t *ClaimsMatcher) matchRole(ctx context.Context, tokenClaims *Claims, rule *Rule, requestedRole string) (bool, error) {
+	role := rule.Role
+	if strings.Contains(role, "${") {
+		template, err := ParseTemplate(role)
+		if err != nil {
+			return false, fmt.Errorf("error parsing role template: %w", err)
+		}
+		if role, err = template.Render(tokenClaims.ClaimsJSON, escapeRoleValue); err != nil {
+			return false, fmt.Errorf("unable to render role template: %w", err)
+		}
+	}
+	if len(rule.Accounts) == 0 && !isRolePattern(role) {
+		return strings.Compare(role, requestedRole) == 0, nil
+	}
+	match, err := matchRolePattern(role, rule.Accounts, requestedRole)
+	if err != nil {
+		return false, fmt.Errorf("error matching role pattern: %w", err)
+	}
+	return match, nil
+}
+
+// matchesDenyRule checks whether the deny rule applies to the requested role and the claims,
+// deny rules which cannot be evaluated apply as well
+func (t *ClaimsMatcher) matchesDenyRule(ctx context.Context, tokenClaims *Claims, rule *Rule, requestedRole string) bool {
+	if rule.Role != "" {
+		match, err := t.matchRole(ctx, tokenClaims, rule, requestedRole)
+		if err != nil {
+			Logger(ctx).Warnf("denying, unable to evaluate deny rule: %s", err)
+			return true
+		}
+		if !match {
+			return false
+		}
+	}
+	match, err := t.matchRule(ctx, tokenClaims, rule)
+	if err != nil {
+		Logger(ctx).Warnf("denying, unable to evaluate deny rule: %s", err)
+		return true
+	}
+	return match
+}
+
+// matchesAllowRule checks whether the allow rule grants the requested role for the claims,
+// allow rules which cannot be evaluated are skipped
+func (t *ClaimsMatcher) matchesAllowRule(ctx context.Context, tokenClaims *Claims, rule *Rule, requestedRole string) bool {
+	match, err := t.matchRole(ctx, tokenClaims, rule, requestedRole)
+	if err != nil {
+		Logger(ctx).Debugf("skipping allow rule: %s", err)
+	}
+	if !match || err != nil {
+		return false
+	}
+	match, err = t.matchRule(ctx, tokenClaims, rule)
+	if err != nil {
+		Logger(ctx).Warnf("skipping allow rule: %s", err)
+	}
+	return match && err == nil
+}
+
+// ValidateClaimsForRule returns the first allow rule for the requested role matching the claims,
+// ErrAccessDenied is returned if any deny rule matches or cannot be evaluated. Deny rules without
+// a role apply to all roles. Role templates are rendered from the claims, the returned rule holds
+// the requested role.
+func (t *ClaimsMatcher) ValidateClaimsForRule(ctx context.Context, tokenClaims *Claims, requestedRole string, rules []Rule) (*Rule, error) {
+	for _, rule := range rules {
+		if rule.IsDeny() && t.matchesDenyRule(ctx, tokenClaims, &rule, requestedRole) {
+			return nil, fmt.Errorf("%w by a deny rule for role %s", ErrAccessDenied, requestedRole)
+		}
+	}
+	for _, rule := range rules {
+		if !rule.IsDeny() && t.matchesAllowRule(ctx, tokenClaims, &rule, requestedRole) {
+			rule.Role = requestedRole
+			return &rule, nil
+		}
+	}
+	return nil, nil
+}
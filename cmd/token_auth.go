@@ -9,7 +9,8 @@ import (
 )
 
 var awsConsumer *auth.AwsConsumer
-var tokenValidator *auth.TokenValidator
+var tokenValidator auth.TokenValidatorInterface
+var replayStore auth.ReplayStore
 
 func init() {
 	loglevel := os.Getenv("LOGLEVEL")
@@ -31,6 +32,11 @@ func init() {
 		roleAnnotationsEnabled = false
 	}
 
+	refreshInterval, err := strconv.ParseInt(os.Getenv("CONFIG_JWKS_REFRESH_INTERVAL"), 10, 64)
+	if err != nil {
+		refreshInterval = 0
+	}
+
 	config := &auth.Config{
 		Bucket:                 bucket,
 		ObjectKey:              key,
@@ -41,16 +47,36 @@ func init() {
 		RoleAnnotationPrefix:   "token_auth/",
 		BoundIssuer:            os.Getenv("CONFIG_BOUND_ISSUER"),
 		BoundAudience:          os.Getenv("CONFIG_BOUND_AUDIENCE"),
+		JwksRefreshInterval:    refreshInterval,
 	}
 
 	awsConsumer, err = auth.NewAwsConsumer(config)
 	if err != nil {
 		log.Fatalf("Error initializing: %v", err)
 	}
-	tokenValidator = auth.NewTokenValidator(awsConsumer.JwksURL(), awsConsumer.BoundIssuer(), awsConsumer.BoundAudience())
+	if introspection := awsConsumer.Introspection(); introspection != nil {
+		if secret := os.Getenv("CONFIG_INTROSPECTION_CLIENT_SECRET"); secret != "" {
+			introspection.ClientSecret = secret
+		}
+		tokenValidator, err = auth.NewIntrospectionValidator(*introspection)
+	} else {
+		var validator *auth.TokenValidator
+		validator, err = auth.NewMultiIssuerTokenValidator(awsConsumer.Issuers(), awsConsumer.RefreshOptions())
+		if err == nil {
+			awsConsumer.OnReload(validator.Reload)
+		}
+		tokenValidator = validator
+	}
+	if err != nil {
+		log.Fatalf("Error initializing: %v", err)
+	}
+	replayStore, err = auth.NewReplayStore(config)
+	if err != nil {
+		log.Fatalf("Error initializing: %v", err)
+	}
 }
 
 func main() {
-	authHandler := auth.NewHandler(awsConsumer, tokenValidator)
+	authHandler := auth.NewHandler(awsConsumer, tokenValidator, replayStore)
 	lambda.Start(authHandler)
 }
@@ -0,0 +1,569 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A condition is a boolean expression on the claims of a token, e.g.
+//
+//	ref_protected == "true" && (ref_type == "tag" || ref == "main")
+//
+// It supports the logical operators &&, || and !, the comparisons ==, !=, <, <=, > and >=,
+// the operators in, startsWith and matches, claim paths like user.groups and string,
+// number, boolean and list literals. Conditions are parsed and type checked once.
+
+// conditionType is the static type of a condition expression
+type conditionType int
+
+const (
+	typeAny conditionType = iota
+	typeBool
+	typeString
+	typeNumber
+	typeList
+)
+
+func (c conditionType) String() string {
+	return [...]string{"claim", "bool", "string", "number", "list"}[c]
+}
+
+// conditionNode is a node of a parsed condition
+type conditionNode interface {
+	// eval returns the value of the node for the given claims
+	eval(claims map[string]interface{}) (interface{}, error)
+	// valueType returns the static type of the node, claims are only known at runtime
+	valueType() conditionType
+}
+
+// Condition is a parsed and type checked condition expression
+type Condition struct {
+	source string
+	root   conditionNode
+}
+
+// conditionCache holds all parsed conditions by their source
+var conditionCache sync.Map
+
+// ParseCondition parses and type checks a condition, every condition is only parsed once
+func ParseCondition(source string) (*Condition, error) {
+	if cached, ok := conditionCache.Load(source); ok {
+		return cached.(*Condition), nil
+	}
+	tokens, err := tokenizeCondition(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", source, err)
+	}
+	parser := &conditionParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err == nil && parser.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %q at position %d", parser.peek().text, parser.peek().pos)
+	}
+	if err == nil && !accepts(root.valueType(), typeBool) {
+		err = fmt.Errorf("expression is a %s, not a bool", root.valueType())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", source, err)
+	}
+	condition := &Condition{source: source, root: root}
+	conditionCache.Store(source, condition)
+	return condition, nil
+}
+
+// Evaluate evaluates the condition against the claims json
+func (c *Condition) Evaluate(claimsJSON []byte) (bool, error) {
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return false, fmt.Errorf("unable to decode claims: %w", err)
+	}
+	result, err := evalBool(c.root, claims)
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %w", c.source, err)
+	}
+	return result, nil
+}
+
+// tokenKind classifies the tokens of a condition
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+// conditionToken is a single token of a condition with its position in the source
+type conditionToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// conditionOperators lists all symbolic operators, longer operators first
+var conditionOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+// tokenizeCondition splits the condition source into tokens
+func tokenizeCondition(source string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	for pos := 0; pos < len(source); {
+		char := rune(source[pos])
+		switch {
+		case unicode.IsSpace(char):
+			pos++
+		case char == '"':
+			end := pos + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			text, err := strconv.Unquote(source[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %w", pos, err)
+			}
+			tokens = append(tokens, conditionToken{kind: tokenString, text: text, pos: pos})
+			pos = end + 1
+		case unicode.IsDigit(char) || (char == '-' && pos+1 < len(source) && unicode.IsDigit(rune(source[pos+1]))):
+			end := pos + 1
+			for end < len(source) && (unicode.IsDigit(rune(source[end])) || source[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenNumber, text: source[pos:end], pos: pos})
+			pos = end
+		case char == '_' || unicode.IsLetter(char):
+			end := pos + 1
+			for end < len(source) && (source[end] == '_' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenIdent, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			operator := ""
+			for _, candidate := range conditionOperators {
+				if strings.HasPrefix(source[pos:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", char, pos)
+			}
+			tokens = append(tokens, conditionToken{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, conditionToken{kind: tokenEOF, pos: len(source)}), nil
+}
+
+// conditionParser is a recursive descent parser for conditions
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is the given operator or keyword
+func (p *conditionParser) accept(text string) bool {
+	token := p.peek()
+	if (token.kind == tokenOperator || token.kind == tokenIdent) && token.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the given operator or fails
+func (p *conditionParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %q at position %d", text, p.peek().pos)
+	}
+	return nil
+}
+
+// parseOr parses: and ('||' and)*
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right conditionNode
+		if right, err = p.parseAnd(); err == nil {
+			left, err = newLogicalNode("||", left, right)
+		}
+	}
+	return left, err
+}
+
+// parseAnd parses: unary ('&&' unary)*
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right conditionNode
+		if right, err = p.parseUnary(); err == nil {
+			left, err = newLogicalNode("&&", left, right)
+		}
+	}
+	return left, err
+}
+
+// parseUnary parses: '!' unary | comparison
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if !accepts(operand.valueType(), typeBool) {
+			return nil, fmt.Errorf("operator ! expects a bool, got a %s", operand.valueType())
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses: primary (operator primary)?
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in", "startsWith", "matches"} {
+		if !p.accept(operator) {
+			continue
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return newComparisonNode(operator, left, right)
+	}
+	return left, nil
+}
+
+// parsePrimary parses literals, lists, claim paths and parenthesized expressions
+func (p *conditionParser) parsePrimary() (conditionNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenString:
+		return &literalNode{value: token.text, kind: typeString}, nil
+	case tokenNumber:
+		if _, ok := parseDecimal(token.text); !ok {
+			return nil, fmt.Errorf("invalid number %q at position %d", token.text, token.pos)
+		}
+		return &literalNode{value: json.Number(token.text), kind: typeNumber}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true", "false":
+			return &literalNode{value: token.text == "true", kind: typeBool}, nil
+		case "in", "startsWith", "matches":
+			return nil, fmt.Errorf("unexpected operator %q at position %d", token.text, token.pos)
+		}
+		path := []string{token.text}
+		for p.accept(".") {
+			segment := p.next()
+			if segment.kind != tokenIdent {
+				return nil, fmt.Errorf("expected claim name at position %d", segment.pos)
+			}
+			path = append(path, segment.text)
+		}
+		return &claimNode{path: path}, nil
+	case tokenOperator:
+		switch token.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	}
+	if token.kind == tokenEOF {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos)
+}
+
+// parseList parses the elements of a list literal after the opening bracket
+func (p *conditionParser) parseList() (conditionNode, error) {
+	list := &literalNode{value: []interface{}{}, kind: typeList}
+	if p.accept("]") {
+		return list, nil
+	}
+	for {
+		element, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		literal, ok := element.(*literalNode)
+		if !ok || literal.kind == typeList {
+			return nil, fmt.Errorf("lists may only contain string, number and bool literals")
+		}
+		list.value = append(list.value.([]interface{}), literal.value)
+		if p.accept("]") {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// accepts checks whether a value of the actual type can be used where the expected type is required
+func accepts(actual conditionType, expected conditionType) bool {
+	return actual == typeAny || actual == expected
+}
+
+// literalNode is a constant value
+type literalNode struct {
+	value interface{}
+	kind  conditionType
+}
+
+func (l *literalNode) eval(claims map[string]interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+func (l *literalNode) valueType() conditionType {
+	return l.kind
+}
+
+// claimNode looks up a claim by its path, missing claims are nil
+type claimNode struct {
+	path []string
+}
+
+func (c *claimNode) eval(claims map[string]interface{}) (interface{}, error) {
+	var value interface{} = claims
+	for _, key := range c.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = object[key]
+	}
+	return value, nil
+}
+
+func (c *claimNode) valueType() conditionType {
+	return typeAny
+}
+
+// notNode negates a bool
+type notNode struct {
+	operand conditionNode
+}
+
+func (n *notNode) eval(claims map[string]interface{}) (interface{}, error) {
+	value, err := evalBool(n.operand, claims)
+	return !value, err
+}
+
+func (n *notNode) valueType() conditionType {
+	return typeBool
+}
+
+// logicalNode combines two bools with && or ||, the right side is only evaluated if required
+type logicalNode struct {
+	operator    string
+	left, right conditionNode
+}
+
+func newLogicalNode(operator string, left, right conditionNode) (conditionNode, error) {
+	if !accepts(left.valueType(), typeBool) || !accepts(right.valueType(), typeBool) {
+		return nil, fmt.Errorf("operator %s expects bools, got a %s and a %s", operator, left.valueType(), right.valueType())
+	}
+	return &logicalNode{operator: operator, left: left, right: right}, nil
+}
+
+func (l *logicalNode) eval(claims map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(l.left, claims)
+	if err != nil {
+		return nil, err
+	}
+	if left == (l.operator == "||") {
+		return left, nil
+	}
+	return evalBool(l.right, claims)
+}
+
+func (l *logicalNode) valueType() conditionType {
+	return typeBool
+}
+
+// evalBool evaluates a node which has to result in a bool, missing claims are false
+// and claims which are no bool are an error
+func evalBool(node conditionNode, claims map[string]interface{}) (bool, error) {
+	value, err := node.eval(claims)
+	if err != nil || value == nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got %v", value)
+	}
+	return result, nil
+}
+
+// comparisonNode compares two values
+type comparisonNode struct {
+	operator    string
+	left, right conditionNode
+	pattern     *regexp.Regexp
+}
+
+func newComparisonNode(operator string, left, right conditionNode) (conditionNode, error) {
+	node := &comparisonNode{operator: operator, left: left, right: right}
+	leftType, rightType := left.valueType(), right.valueType()
+	switch operator {
+	case "==", "!=":
+		if leftType != typeAny && rightType != typeAny && leftType != rightType {
+			return nil, fmt.Errorf("operator %s compares a %s with a %s", operator, leftType, rightType)
+		}
+	case "<", "<=", ">", ">=":
+		for _, operandType := range []conditionType{leftType, rightType} {
+			if operandType != typeAny && operandType != typeNumber && operandType != typeString {
+				return nil, fmt.Errorf("operator %s expects numbers or strings, got a %s", operator, operandType)
+			}
+		}
+	case "in":
+		if !accepts(rightType, typeList) {
+			return nil, fmt.Errorf("operator in expects a list, got a %s", rightType)
+		}
+		if leftType == typeList {
+			return nil, fmt.Errorf("operator in expects a single value, got a list")
+		}
+	case "startsWith":
+		if !accepts(leftType, typeString) || !accepts(rightType, typeString) {
+			return nil, fmt.Errorf("operator startsWith expects strings, got a %s and a %s", leftType, rightType)
+		}
+	case "matches":
+		literal, ok := right.(*literalNode)
+		if !accepts(leftType, typeString) || !ok || literal.kind != typeString {
+			return nil, fmt.Errorf("operator matches expects a string and a regular expression literal")
+		}
+		pattern, err := compilePattern(regexPattern, literal.value.(string))
+		if err != nil {
+			return nil, err
+		}
+		node.pattern = pattern
+	}
+	return node, nil
+}
+
+func (c *comparisonNode) eval(claims map[string]interface{}) (interface{}, error) {
+	left, err := c.left.eval(claims)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.right.eval(claims)
+	if err != nil {
+		return nil, err
+	}
+	switch c.operator {
+	case "==":
+		return conditionEqual(left, right), nil
+	case "!=":
+		return !conditionEqual(left, right), nil
+	case "in":
+		list, _ := right.([]interface{})
+		for _, element := range list {
+			if conditionEqual(left, element) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "startsWith":
+		text, ok := left.(string)
+		prefix, isString := right.(string)
+		return ok && isString && strings.HasPrefix(text, prefix), nil
+	case "matches":
+		text, ok := left.(string)
+		return ok && c.pattern.MatchString(text), nil
+	}
+	return conditionCompare(c.operator, left, right), nil
+}
+
+func (c *comparisonNode) valueType() conditionType {
+	return typeBool
+}
+
+// conditionEqual compares two values of the same type, numbers by their exact value.
+// Missing claims and null values are never equal, not even to each other.
+func conditionEqual(left, right interface{}) bool {
+	switch typed := left.(type) {
+	case string, bool:
+		return left == right
+	case json.Number:
+		other, ok := right.(json.Number)
+		if !ok {
+			return false
+		}
+		leftNumber, ok := parseDecimal(typed.String())
+		rightNumber, isNumber := parseDecimal(other.String())
+		return ok && isNumber && leftNumber.Cmp(rightNumber) == 0
+	}
+	return false
+}
+
+// conditionCompare orders two strings lexically, otherwise numbers and numeric strings numerically
+func conditionCompare(operator string, left, right interface{}) bool {
+	var order int
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+	if leftIsString && rightIsString {
+		order = strings.Compare(leftString, rightString)
+	} else {
+		leftNumber, ok := conditionNumber(left)
+		rightNumber, isNumber := conditionNumber(right)
+		if !ok || !isNumber {
+			return false
+		}
+		order = leftNumber.Cmp(rightNumber)
+	}
+	switch operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// conditionNumber converts numbers and numeric strings, as GitLab sends its ids as strings
+func conditionNumber(value interface{}) (*big.Rat, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		return parseDecimal(typed.String())
+	case string:
+		return parseDecimal(typed)
+	}
+	return nil, false
+}
@@ -0,0 +1,149 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestCondition_Evaluate(t *testing.T) {
+	claims := []byte(`{"ref": "main", "ref_type": "branch", "ref_protected": "true", "project_id": "1093", "runner_id": 12,
+		"groups": ["developers", "deployers"], "user": {"login": "jdoe", "admin": false},
+		"user_id": 9007199254740993, "nan": "NaN", "inf": "Infinity", "hex": "0x1p4", "empty": null}`)
+
+	tests := map[string]struct {
+		Condition string
+		IsMatch   bool
+	}{
+		"01_example":                {`ref_protected == "true" && (ref_type == "tag" || ref == "main")`, true},
+		"02_equal_mismatch":         {`ref == "develop"`, false},
+		"03_not_equal":              {`ref != "develop"`, true},
+		"04_not":                    {`!(ref_type == "tag")`, true},
+		"05_or_short_circuit":       {`ref == "main" || missing`, true},
+		"06_and_short_circuit":      {`ref == "develop" && missing`, false},
+		"07_in_list":                {`ref in ["main", "develop"]`, true},
+		"08_not_in_list":            {`ref_type in ["tag"]`, false},
+		"09_in_claim_array":         {`"deployers" in groups`, true},
+		"10_starts_with":            {`ref startsWith "ma"`, true},
+		"11_starts_with_mismatch":   {`ref startsWith "release/"`, false},
+		"12_matches":                {`ref matches "^(main|master)$"`, true},
+		"13_nested_path":            {`user.login == "jdoe" && user.admin == false`, true},
+		"14_number_comparison":      {`runner_id >= 12 && runner_id < 13`, true},
+		"15_numeric_string":         {`project_id > 1000`, true},
+		"16_string_order":           {`ref > "a"`, true},
+		"17_missing_claim":          {`missing == "x"`, false},
+		"18_missing_nested_claim":   {`ref.name == "x"`, false},
+		"19_bool_claim":             {`!user.admin`, true},
+		"20_type_mismatch":          {`runner_id == "12"`, false},
+		"21_not_missing_claim":      {`!trusted`, true},
+		"22_missing_claim_is_false": {`trusted || ref == "develop"`, false},
+		"23_nan_string":             {`nan >= 0 || nan <= 0`, false},
+		"24_infinite_string":        {`inf > 0`, false},
+		"25_hex_string":             {`hex > 15`, false},
+		"26_large_number_equal":     {`user_id == 9007199254740993 && user_id != 9007199254740992`, true},
+		"27_large_number_order":     {`user_id > 9007199254740992`, true},
+		"28_number_value_equal":     {`runner_id == 12.0`, true},
+		"29_missing_claims_unequal": {`missing_a == missing_b`, false},
+		"30_null_claim_unequal":     {`empty == missing`, false},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			condition, err := auth.ParseCondition(testCase.Condition)
+			assert.NoError(t, err)
+			matches, err := condition.Evaluate(claims)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.IsMatch, matches)
+		})
+	}
+
+	t.Run("claim which is no bool", func(t *testing.T) {
+		condition, err := auth.ParseCondition(`ref && true`)
+		assert.NoError(t, err)
+		_, err = condition.Evaluate(claims)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := map[string]string{
+		"01_empty":                 ``,
+		"02_unterminated_string":   `ref == "main`,
+		"03_unbalanced":            `(ref == "main"`,
+		"04_trailing_tokens":       `ref == "main" ref`,
+		"05_no_bool":               `"main"`,
+		"06_literal_type_mismatch": `1 == "1"`,
+		"07_logical_with_string":   `ref == "main" && "tag"`,
+		"08_in_without_list":       `ref in "main"`,
+		"09_invalid_regex":         `ref matches "^(main"`,
+		"10_matches_claim":         `ref matches pattern`,
+		"11_unknown_character":     `ref = "main"`,
+		"12_nested_list":           `ref in [["main"]]`,
+		"13_compare_bools":         `true < false`,
+		"14_not_string":            `!"main"`,
+	}
+	for name, source := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := auth.ParseCondition(source)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTokenValidator_ValidateClaimsForRule_Condition(t *testing.T) {
+	ctx := context.TODO()
+	claims := &auth.Claims{ClaimsJSON: []byte(`{"namespace_path": "AOEpeople", "ref": "main", "ref_protected": "true"}`)}
+	rules := []auth.Rule{
+		{
+			Role:        "arn:aws:iam::012345678910:role/deploy",
+			ClaimValues: []byte(`{"namespace_path": "AOEpeople"}`),
+			Condition:   `ref_protected == "true" && ref == "develop"`,
+		},
+		{
+			Role:      "arn:aws:iam::012345678910:role/deploy",
+			Condition: `ref_protected == "true" && ref == "main"`,
+		},
+	}
+
+	tokenValidator := auth.TokenValidator{}
+	rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/deploy", rules)
+	assert.NoError(t, err)
+	assert.Equal(t, &rules[1], rule)
+}
+
+func TestTokenValidator_ValidateClaimsForRule_DenyCondition(t *testing.T) {
+	ctx := context.TODO()
+	rules := []auth.Rule{
+		{
+			Effect:    auth.EffectDeny,
+			Condition: `!trusted`,
+		},
+		{
+			Role:        "arn:aws:iam::012345678910:role/deploy",
+			ClaimValues: []byte(`{"namespace_path": "AOEpeople"}`),
+		},
+	}
+	tokenValidator := auth.TokenValidator{}
+
+	t.Run("denies tokens with missing claim", func(t *testing.T) {
+		claims := &auth.Claims{ClaimsJSON: []byte(`{"namespace_path": "AOEpeople"}`)}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/deploy", rules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("denies tokens if the condition fails", func(t *testing.T) {
+		claims := &auth.Claims{ClaimsJSON: []byte(`{"namespace_path": "AOEpeople", "trusted": "yes"}`)}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/deploy", rules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("allows tokens not matching the condition", func(t *testing.T) {
+		claims := &auth.Claims{ClaimsJSON: []byte(`{"namespace_path": "AOEpeople", "trusted": true}`)}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/deploy", rules)
+		assert.NoError(t, err)
+		assert.Equal(t, &rules[1], rule)
+	})
+}
@@ -1,15 +1,178 @@
 package auth
 
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
 // Config holds all configuration for the Handler
 type Config struct {
 	Bucket                 string
 	ObjectKey              string
-	JwksURL                string `json:"jwks_url"`
-	RoleAnnotationsEnabled bool   `json:"role_annotations_enabled"`
-	RoleAnnotationPrefix   string `json:"role_annotation_prefix"`
-	BoundIssuer            string `json:"bound_issuer"`
-	BoundAudience          string `json:"bound_audience"`
-	Region                 string `json:"region"`
-	Duration               int64  `json:"duration"`
-	Rules                  []Rule `json:"rules"`
+	JwksURL                string               `json:"jwks_url"`
+	RoleAnnotationsEnabled bool                 `json:"role_annotations_enabled"`
+	RoleAnnotationPrefix   string               `json:"role_annotation_prefix"`
+	BoundIssuer            string               `json:"bound_issuer"`
+	BoundAudience          string               `json:"bound_audience"`
+	Issuers                []IssuerConfig       `json:"issuers"`
+	Introspection          *IntrospectionConfig `json:"introspection"`
+	JwksRefreshInterval    int64                `json:"jwks_refresh_interval"`
+	JwksRefreshRateLimit   int64                `json:"jwks_refresh_rate_limit"`
+	ReplayProtection       string               `json:"replay_protection"`
+	ReplayTable            string               `json:"replay_table"`
+	Region                 string               `json:"region"`
+	Duration               int64                `json:"duration"`
+	LimitDurationToToken   bool                 `json:"limit_duration_to_token"`
+	SessionName            string               `json:"session_name"`
+	ReaderRoles            map[string]string    `json:"reader_roles"`
+	AccountID              string               `json:"account_id"`
+	CoerceTypes            bool                 `json:"coerce_types"`
+	AllowAnyRole           bool                 `json:"allow_any_role"`
+	Rules                  []Rule               `json:"rules"`
+}
+
+// IssuerConfig holds the validation settings for a single token issuer. The key set is
+// either given inline (Jwks, or an S3 object loaded into Jwks), fetched from JwksURL
+// or taken from the OIDC discovery document of the issuer
+type IssuerConfig struct {
+	Issuer            string            `json:"issuer"`
+	JwksURL           string            `json:"jwks_url"`
+	Jwks              json.RawMessage   `json:"jwks"`
+	JwksBucket        string            `json:"jwks_bucket"`
+	JwksObjectKey     string            `json:"jwks_object_key"`
+	BoundAudience     string            `json:"bound_audience"`
+	RequiredClaims    json.RawMessage   `json:"required_claims"`
+	AllowedAlgorithms []string          `json:"allowed_algorithms"`
+	AllowedKids       []string          `json:"allowed_kids"`
+	Leeway            int64             `json:"leeway"`
+	MaxTokenAge       int64             `json:"max_token_age"`
+	RequireExpiration bool              `json:"require_exp"`
+	RequireIssuedAt   bool              `json:"require_iat"`
+	Flavor            string            `json:"flavor"`
+	KnownClaimTypes   map[string]string `json:"claim_types"`
+}
+
+// IssuerConfigs returns the configured issuers, falling back to the single
+// issuer settings (jwks_url, bound_issuer, bound_audience) if no list is given
+func (c *Config) IssuerConfigs() []IssuerConfig {
+	if len(c.Issuers) > 0 {
+		return c.Issuers
+	}
+	if c.JwksURL == "" && c.BoundIssuer == "" {
+		return nil
+	}
+	return []IssuerConfig{{
+		Issuer:        c.BoundIssuer,
+		JwksURL:       c.JwksURL,
+		BoundAudience: c.BoundAudience,
+	}}
+}
+
+// RefreshOptions returns the key set refresh settings, the configured values are seconds
+func (c *Config) RefreshOptions() RefreshOptions {
+	return RefreshOptions{
+		Interval:  time.Duration(c.JwksRefreshInterval) * time.Second,
+		RateLimit: time.Duration(c.JwksRefreshRateLimit) * time.Second,
+	}
+}
+
+// validRegion describes the names of AWS regions, e.g. eu-central-1 or us-gov-west-1
+var validRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// Validate checks the rules and issuers of the configuration and prepares all patterns
+func (c *Config) Validate() error {
+	if c.Region != "" && !validRegion.MatchString(c.Region) {
+		return fmt.Errorf("invalid region %q", c.Region)
+	}
+	if _, err := ParseTemplate(c.SessionName); err != nil {
+		return fmt.Errorf("invalid session name: %w", err)
+	}
+	if err := validateReaderRoles(c.ReaderRoles); err != nil {
+		return err
+	}
+	if c.AccountID != "" && !validAccountID.MatchString(c.AccountID) {
+		return fmt.Errorf("invalid account id %q", c.AccountID)
+	}
+	for i, rule := range c.Rules {
+		if rule.Effect != "" && rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("invalid effect %q of rule %d (%s)", rule.Effect, i, rule.Role)
+		}
+		if err := ValidateClaimValues(rule.ClaimValues); err != nil {
+			return fmt.Errorf("invalid claim_values of rule %d (%s): %w", i, rule.Role, err)
+		}
+		if _, err := ParseTemplate(rule.Role); err != nil {
+			return fmt.Errorf("invalid role of rule %d: %w", i, err)
+		}
+		if err := validateRolePattern(rule, c.AllowAnyRole); err != nil {
+			return fmt.Errorf("invalid role of rule %d: %w", i, err)
+		}
+		if err := validateSessionTags(rule); err != nil {
+			return fmt.Errorf("invalid session tags of rule %d (%s): %w", i, rule.Role, err)
+		}
+		if err := validateSessionPolicy(rule); err != nil {
+			return fmt.Errorf("invalid session policy of rule %d (%s): %w", i, rule.Role, err)
+		}
+		if rule.Region != "" && !validRegion.MatchString(rule.Region) {
+			return fmt.Errorf("invalid region %q of rule %d (%s)", rule.Region, i, rule.Role)
+		}
+		if _, err := ParseTemplate(rule.SessionName); err != nil {
+			return fmt.Errorf("invalid session name of rule %d (%s): %w", i, rule.Role, err)
+		}
+		for _, hop := range rule.Via {
+			if _, err := ParseRoleArn(hop); err != nil {
+				return fmt.Errorf("invalid via role %q of rule %d (%s): %w", hop, i, rule.Role, err)
+			}
+		}
+		if err := validateSourceIdentity(rule); err != nil {
+			return fmt.Errorf("invalid rule %d (%s): %w", i, rule.Role, err)
+		}
+		if rule.Condition != "" {
+			if _, err := ParseCondition(rule.Condition); err != nil {
+				return fmt.Errorf("invalid condition of rule %d (%s): %w", i, rule.Role, err)
+			}
+		}
+	}
+	for i, issuer := range c.Issuers {
+		if issuer.Issuer == "" {
+			return fmt.Errorf("issuer %d of the issuers list has no issuer", i)
+		}
+		if err := ValidateClaimValues(issuer.RequiredClaims); err != nil {
+			return fmt.Errorf("invalid required_claims of issuer %q: %w", issuer.Issuer, err)
+		}
+		if err := issuer.validateClaimTypes(); err != nil {
+			return fmt.Errorf("invalid claim types of issuer %q: %w", issuer.Issuer, err)
+		}
+	}
+	return nil
+}
+
+// clone copies the configuration, lists and maps are copied so that decoding into
+// the copy does not change the original configuration
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Issuers = append([]IssuerConfig(nil), c.Issuers...)
+	clone.Rules = append([]Rule(nil), c.Rules...)
+	if c.Introspection != nil {
+		introspection := *c.Introspection
+		clone.Introspection = &introspection
+	}
+	if c.ReaderRoles != nil {
+		clone.ReaderRoles = make(map[string]string, len(c.ReaderRoles))
+		for account, role := range c.ReaderRoles {
+			clone.ReaderRoles[account] = role
+		}
+	}
+	return &clone
+}
+
+// applyDefaults sets the global coerce_types option on all rules which do not configure it
+func (c *Config) applyDefaults() {
+	for i := range c.Rules {
+		if c.Rules[i].CoerceTypes == nil {
+			coerceTypes := c.CoerceTypes
+			c.Rules[i].CoerceTypes = &coerceTypes
+		}
+	}
 }
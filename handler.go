@@ -2,17 +2,24 @@ package auth
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
 // Event all data we expect within a request
 type Event struct {
-	Headers EventHeaders `json:"headers"`
-	Query   EventQuery   `json:"queryStringParameters"`
+	Headers         EventHeaders `json:"headers"`
+	Query           EventQuery   `json:"queryStringParameters"`
+	Body            string       `json:"body,omitempty"`
+	IsBase64Encoded bool         `json:"isBase64Encoded,omitempty"`
 }
 
 // EventHeaders all header fields we expect in a request
@@ -23,7 +30,8 @@ type EventHeaders struct {
 
 // EventQuery all query fields we expect in a request
 type EventQuery struct {
-	Role string `json:"role"`
+	Role     string `json:"role"`
+	Duration string `json:"duration,omitempty"`
 }
 
 // Claims all claim fields a token from Gitlab could have
@@ -32,57 +40,238 @@ type Claims struct {
 	RegisteredClaims *jwt.RegisteredClaims
 }
 
+// Effects of a Rule, deny rules take precedence over allow rules
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
 // Rule represents a single claim to role mapping
 type Rule struct {
 	Role        string          `json:"role"`
+	Accounts    []string        `json:"accounts"`
 	Region      string          `json:"region"`
 	Duration    int64           `json:"duration"`
+	Effect      string          `json:"effect"`
+	CoerceTypes *bool           `json:"coerce_types"`
 	ClaimValues json.RawMessage `json:"claim_values"`
+	Condition   string          `json:"condition"`
+	// SessionTags maps tag keys to claim paths or templates, e.g. {"project": "project_path"}
+	SessionTags       map[string]string `json:"session_tags"`
+	TransitiveTagKeys []string          `json:"transitive_tag_keys"`
+	// SessionPolicy is an inline policy template, claims are used within its strings, e.g. "arn:aws:s3:::artifacts/${project_path}/*"
+	SessionPolicy json.RawMessage `json:"session_policy"`
+	PolicyArns    []string        `json:"policy_arns"`
+	// SourceIdentity is a claim path or template, e.g. "user_login"
+	SourceIdentity string `json:"source_identity"`
+	ExternalID     string `json:"external_id"`
+	// SessionName is a template of the role session name, e.g. "gl-${project_id}-${pipeline_id}-${job_id}"
+	SessionName string `json:"session_name"`
+	// Via lists the roles which are assumed in turn to reach the role, e.g. a broker role trusted by the target account
+	Via []string `json:"via"`
+}
+
+// MatchOptions returns the options used to match the claim values of the rule
+func (r *Rule) MatchOptions() MatchOptions {
+	return MatchOptions{CoerceTypes: r.CoerceTypes != nil && *r.CoerceTypes}
+}
+
+// IsDeny reports whether the rule blocks matching tokens instead of granting the role
+func (r *Rule) IsDeny() bool {
+	return r.Effect == EffectDeny
 }
 
 // Handler lambda function interface
 type Handler func(ctx context.Context, event Event) (HandlerResponse, error)
 
-// NewHandler creates the actual Handler function
-func NewHandler(consumer AwsConsumerInterface, validator TokenValidatorInterface) Handler {
+// roleRequest tracks a single requested role through the handler
+type roleRequest struct {
+	role        string
+	iamRules    []Rule
+	rule        *Rule
+	credentials *Credentials
+	statusCode  int
+	err         error
+}
+
+// fail records the error of the role, the role is skipped by all further steps
+func (r *roleRequest) fail(err error, statusCode int) {
+	r.err = err
+	r.statusCode = statusCode
+}
+
+// eventBody is the optional JSON body of a request
+type eventBody struct {
+	Roles []string `json:"roles"`
+}
+
+// splitRoles splits the comma separated list of the role query parameter, as role names may contain
+// commas the list is only split where the next role arn starts
+func splitRoles(query string) []string {
+	var roles []string
+	for _, part := range strings.Split(query, ",") {
+		if len(roles) > 0 && !strings.HasPrefix(strings.TrimSpace(part), "arn:") {
+			roles[len(roles)-1] += "," + part
+			continue
+		}
+		roles = append(roles, part)
+	}
+	return roles
+}
+
+// requestedRoles returns the distinct roles of the role query parameter, which holds a comma separated
+// list of role arns if given several times, and of the roles list within the JSON body
+func requestedRoles(event Event) ([]string, error) {
+	var roles []string
+	if event.Query.Role != "" {
+		roles = splitRoles(event.Query.Role)
+	}
+	if event.Body != "" {
+		body := []byte(event.Body)
+		if event.IsBase64Encoded {
+			decoded, err := base64.StdEncoding.DecodeString(event.Body)
+			if err != nil {
+				return nil, err
+			}
+			body = decoded
+		}
+		var decoded eventBody
+		if err := json.Unmarshal(body, &decoded); err != nil {
+			return nil, err
+		}
+		roles = append(roles, decoded.Roles...)
+	}
+	var distinct []string
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if role != "" && !contains(distinct, role) {
+			distinct = append(distinct, role)
+		}
+	}
+	return distinct, nil
+}
+
+// forEachRole calls the function concurrently for all requested roles without error
+func forEachRole(requests []*roleRequest, f func(request *roleRequest)) {
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		if request.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(request *roleRequest) {
+			defer wg.Done()
+			f(request)
+		}(request)
+	}
+	wg.Wait()
+}
+
+// NewHandler creates the actual Handler function, replayStore is optional and enables one-time use of tokens.
+// Several roles can be requested at once, the token is validated once and the roles are assumed concurrently.
+func NewHandler(consumer AwsConsumerInterface, validator TokenValidatorInterface, replayStore ReplayStore) Handler {
 	return func(ctx context.Context, event Event) (HandlerResponse, error) {
 		logger := Logger(ctx)
 
-		if event.Headers.Authorization == "" || event.Query.Role == "" {
+		roles, err := requestedRoles(event)
+		if err != nil || event.Headers.Authorization == "" || len(roles) == 0 {
 			return RespondError(ctx, fmt.Errorf("invalid arguments"), http.StatusBadRequest)
 		}
+		var requestedDuration int64
+		if event.Query.Duration != "" {
+			duration, err := strconv.ParseInt(event.Query.Duration, 10, 64)
+			if err != nil || duration <= 0 {
+				return RespondError(ctx, fmt.Errorf("invalid duration"), http.StatusBadRequest)
+			}
+			requestedDuration = duration
+		}
 
-		iamRules, err := consumer.RetrieveRulesFromRoleTags(ctx, event.Query.Role)
-		if err != nil {
-			return RespondError(ctx, err, http.StatusBadRequest)
+		requests := make([]*roleRequest, 0, len(roles))
+		for _, role := range roles {
+			requests = append(requests, &roleRequest{role: role, statusCode: http.StatusOK})
 		}
-		logger.Infof("Retrieved Event for Role %s\n%s", event.Query.Role, event.Headers.Authorization)
+		forEachRole(requests, func(request *roleRequest) {
+			iamRules, err := consumer.RetrieveRulesFromRoleTags(ctx, request.role)
+			if errors.Is(err, ErrRoleLookupUnavailable) {
+				request.fail(err, http.StatusServiceUnavailable)
+			} else if err != nil {
+				request.fail(err, http.StatusBadRequest)
+			}
+			request.iamRules = iamRules
+		})
+		if len(requests) == 1 && requests[0].err != nil {
+			return RespondError(ctx, requests[0].err, requests[0].statusCode)
+		}
+		logger.Infof("Retrieved Event for Role %s\n%s", strings.Join(roles, ", "), event.Headers.Authorization)
 
-		rules := append(consumer.Rules(), iamRules...)
+		globalRules := consumer.Rules()
 		claims, err := validator.RetrieveClaimsFromToken(ctx, event.Headers.Authorization)
-		if err != nil {
+		if errors.Is(err, ErrKeysUnavailable) || errors.Is(err, ErrIntrospectionUnavailable) {
+			return RespondError(ctx, err, http.StatusServiceUnavailable)
+		} else if err != nil {
 			return RespondError(ctx, err, http.StatusUnauthorized)
 		}
 		logger.Debugf("Claims JSON: %s", claims.ClaimsJSON)
 		logger.Infof("Validated Token")
 
-		role, err := validator.ValidateClaimsForRule(ctx, claims, event.Query.Role, rules)
-		if err != nil {
-			return RespondError(ctx, err, http.StatusInternalServerError)
-		} else if role == nil {
-			return RespondError(ctx, fmt.Errorf("unable to find matching role for the given token"), http.StatusUnauthorized)
+		if replayStore != nil {
+			err := replayStore.MarkUsed(ctx, ReplayKey(claims, event.Headers.Authorization), ReplayExpiry(claims))
+			if errors.Is(err, ErrTokenReplayed) {
+				return RespondError(ctx, err, http.StatusUnauthorized)
+			} else if err != nil {
+				return RespondError(ctx, err, http.StatusInternalServerError)
+			}
 		}
 
-		logger.Infof("Retrieved request from %s to assume role %s", claims.RegisteredClaims.Subject, role.Role)
-		credentials, err := consumer.AssumeRole(ctx, role, claims.RegisteredClaims.Subject)
-		if err != nil {
-			return RespondError(ctx, err, http.StatusInternalServerError)
+		for _, request := range requests {
+			if request.err != nil {
+				continue
+			}
+			rules := append(globalRules[:len(globalRules):len(globalRules)], request.iamRules...)
+			role, err := validator.ValidateClaimsForRule(ctx, claims, request.role, rules)
+			if errors.Is(err, ErrAccessDenied) {
+				request.fail(err, http.StatusForbidden)
+			} else if err != nil {
+				request.fail(err, http.StatusInternalServerError)
+			} else if role == nil {
+				request.fail(fmt.Errorf("unable to find matching role for the given token"), http.StatusUnauthorized)
+			}
+			request.rule = role
 		}
 
-		if event.Headers.Accept == "text/x-shellscript" {
-			return RespondShellscript(ctx, credentials)
+		forEachRole(requests, func(request *roleRequest) {
+			logger.Infof("Retrieved request from %s to assume role %s", claims.RegisteredClaims.Subject, request.rule.Role)
+			credentials, err := consumer.AssumeRole(ctx, request.rule, claims, requestedDuration)
+			if errors.Is(err, ErrTokenExpiresTooSoon) {
+				request.fail(err, http.StatusUnauthorized)
+			} else if err != nil {
+				request.fail(err, http.StatusInternalServerError)
+			}
+			request.credentials = credentials
+		})
+
+		if len(requests) == 1 {
+			if requests[0].err != nil {
+				return RespondError(ctx, requests[0].err, requests[0].statusCode)
+			}
+			if event.Headers.Accept == "text/x-shellscript" {
+				return RespondShellscript(ctx, requests[0].credentials)
+			}
+			return RespondJSON(ctx, requests[0].credentials)
 		}
 
-		return RespondJSON(ctx, credentials)
+		results := map[string]RoleResult{}
+		for _, request := range requests {
+			result := RoleResult{StatusCode: request.statusCode, Credentials: request.credentials}
+			if request.err != nil {
+				logger.Errorf("error response for role %s %d, %s", request.role, request.statusCode, request.err.Error())
+				result.Error = request.err.Error()
+			}
+			results[request.role] = result
+		}
+		if event.Headers.Accept == "text/x-shellscript" {
+			return RespondProfiles(ctx, results)
+		}
+		return RespondRolesJSON(ctx, results)
 	}
 }
@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/aws"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 // HandlerResponse the response format expected by Lambda
@@ -27,13 +31,22 @@ func RespondError(ctx context.Context, err error, statusCode int) (HandlerRespon
 }
 
 // RespondShellscript format a response as a shellscript
-func RespondShellscript(ctx context.Context, credentials *sts.Credentials) (HandlerResponse, error) {
+func RespondShellscript(ctx context.Context, credentials *Credentials) (HandlerResponse, error) {
 	data := fmt.Sprintf("export AWS_ACCESS_KEY_ID=\"%s\"\n"+
 		"export AWS_SECRET_ACCESS_KEY=\"%s\"\n"+
 		"export AWS_SESSION_TOKEN=\"%s\"\n",
 		*credentials.AccessKeyId,
 		*credentials.SecretAccessKey,
 		*credentials.SessionToken)
+	if credentials.Expiration != nil {
+		data += fmt.Sprintf("export AWS_CREDENTIAL_EXPIRATION=\"%s\"\n", credentials.Expiration.UTC().Format(time.RFC3339))
+	}
+	if credentials.Region != "" {
+		data += fmt.Sprintf("export AWS_REGION=\"%s\"\n"+
+			"export AWS_DEFAULT_REGION=\"%s\"\n",
+			credentials.Region,
+			credentials.Region)
+	}
 	Logger(ctx).Debug("response successful - responding credentials as script")
 	return HandlerResponse{
 		StatusCode: http.StatusOK,
@@ -45,7 +58,7 @@ func RespondShellscript(ctx context.Context, credentials *sts.Credentials) (Hand
 }
 
 // RespondJSON format a response as json
-func RespondJSON(ctx context.Context, credentials *sts.Credentials) (HandlerResponse, error) {
+func RespondJSON(ctx context.Context, credentials *Credentials) (HandlerResponse, error) {
 	response, err := json.Marshal(&credentials)
 	if err != nil {
 		return RespondError(ctx, err, http.StatusInternalServerError)
@@ -59,3 +72,101 @@ func RespondJSON(ctx context.Context, credentials *sts.Credentials) (HandlerResp
 		Body: string(response),
 	}, nil
 }
+
+// RoleResult is the outcome for a single role of a request for several roles
+type RoleResult struct {
+	StatusCode  int          `json:"StatusCode"`
+	Error       string       `json:"Error,omitempty"`
+	Credentials *Credentials `json:"Credentials,omitempty"`
+}
+
+// RespondRolesJSON format a response for several roles as json keyed by the role
+func RespondRolesJSON(ctx context.Context, results map[string]RoleResult) (HandlerResponse, error) {
+	response, err := json.Marshal(results)
+	if err != nil {
+		return RespondError(ctx, err, http.StatusInternalServerError)
+	}
+	Logger(ctx).Debug("response successful - responding credentials of several roles as json")
+	return HandlerResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(response),
+	}, nil
+}
+
+// RespondProfiles format a response for several roles as a shellscript writing a named AWS profile per role,
+// roles which could not be assumed are listed as comments
+func RespondProfiles(ctx context.Context, results map[string]RoleResult) (HandlerResponse, error) {
+	roles := make([]string, 0, len(results))
+	for role := range results {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	profiles := ProfileNames(roles)
+
+	var data strings.Builder
+	for _, role := range roles {
+		result := results[role]
+		if result.Credentials == nil {
+			data.WriteString(fmt.Sprintf("# %s: %d %s\n", scriptComment(role), result.StatusCode, scriptComment(result.Error)))
+			continue
+		}
+		settings := [][2]string{
+			{"aws_access_key_id", aws.StringValue(result.Credentials.AccessKeyId)},
+			{"aws_secret_access_key", aws.StringValue(result.Credentials.SecretAccessKey)},
+			{"aws_session_token", aws.StringValue(result.Credentials.SessionToken)},
+		}
+		if result.Credentials.Region != "" {
+			settings = append(settings, [2]string{"region", result.Credentials.Region})
+		}
+		data.WriteString(fmt.Sprintf("# %s\n", scriptComment(role)))
+		for _, setting := range settings {
+			data.WriteString(fmt.Sprintf("aws configure set %s \"%s\" --profile \"%s\"\n", setting[0], setting[1], profiles[role]))
+		}
+	}
+	Logger(ctx).Debug("response successful - responding credentials of several roles as profile script")
+	return HandlerResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/x-shellscript",
+		},
+		Body: data.String(),
+	}, nil
+}
+
+// invalidCommentChars matches control characters and line separators which could end a comment of a shellscript
+var invalidCommentChars = regexp.MustCompile(`[\p{Cc}\p{Zl}\p{Zp}]`)
+
+// scriptComment makes the text safe for its use within a comment of a shellscript, the text may
+// hold the roles requested by the caller
+func scriptComment(text string) string {
+	return invalidCommentChars.ReplaceAllLiteralString(text, " ")
+}
+
+// ProfileNames returns the AWS profile names of the roles, profiles are named after the role name
+// and prefixed with the account id if several roles share their name
+func ProfileNames(roles []string) map[string]string {
+	counts := map[string]int{}
+	parsed := map[string]*RoleArn{}
+	for _, role := range roles {
+		if arn, err := ParseRoleArn(role); err == nil {
+			parsed[role] = arn
+			counts[arn.Name]++
+		}
+	}
+	profiles := map[string]string{}
+	for _, role := range roles {
+		arn, ok := parsed[role]
+		switch {
+		case !ok:
+			profiles[role] = invalidSessionNameChars.ReplaceAllLiteralString(role, "_")
+		case counts[arn.Name] > 1:
+			profiles[role] = arn.Account + "-" + arn.Name
+		default:
+			profiles[role] = arn.Name
+		}
+	}
+	return profiles
+}
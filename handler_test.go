@@ -2,9 +2,13 @@ package auth_test
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/golang-jwt/jwt/v4"
 	auth "token_authorizer"
@@ -23,7 +27,7 @@ func TestAuthorizationHandler(t *testing.T) {
 
 		validator := mock.NewMockTokenValidatorInterface(ctrl)
 		consumer := mock.NewMockAwsConsumerInterface(ctrl)
-		handler := auth.NewHandler(consumer, validator)
+		handler := auth.NewHandler(consumer, validator, nil)
 		response, err := handler(ctx, auth.Event{})
 		assert.NoError(t, err)
 		assert.Equal(t, "invalid arguments", response.Body)
@@ -56,10 +60,10 @@ func TestAuthorizationHandler(t *testing.T) {
 
 		consumer := mock.NewMockAwsConsumerInterface(ctrl)
 		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
-		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq("hans")).Return(&sts.Credentials{}, nil)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{Credentials: &sts.Credentials{}}, nil)
 		consumer.EXPECT().Rules().Return(rules)
 
-		handler := auth.NewHandler(consumer, validator)
+		handler := auth.NewHandler(consumer, validator, nil)
 		event := auth.Event{
 			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
 			Query:   auth.EventQuery{Role: "one"},
@@ -92,10 +96,10 @@ func TestAuthorizationHandler(t *testing.T) {
 
 		consumer := mock.NewMockAwsConsumerInterface(ctrl)
 		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(iamRules, nil)
-		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&iamRules[0]), gomock.Eq("hans")).Return(&sts.Credentials{}, nil)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&iamRules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{Credentials: &sts.Credentials{}}, nil)
 		consumer.EXPECT().Rules().Return(globalRules)
 
-		handler := auth.NewHandler(consumer, validator)
+		handler := auth.NewHandler(consumer, validator, nil)
 		event := auth.Event{
 			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
 			Query:   auth.EventQuery{Role: "one"},
@@ -105,4 +109,389 @@ func TestAuthorizationHandler(t *testing.T) {
 		assert.Equal(t, "{\"AccessKeyId\":null,\"Expiration\":null,\"SecretAccessKey\":null,\"SessionToken\":null}", response.Body)
 		assert.Equal(t, http.StatusOK, response.StatusCode)
 	})
+
+	t.Run("args valid - shellscript with region and duration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		rules := []auth.Rule{{
+			Role:        "one",
+			Region:      "eu-central-1",
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues, RegisteredClaims: &jwt.RegisteredClaims{Subject: "hans"}}
+		credentials := &auth.Credentials{
+			Credentials: &sts.Credentials{
+				AccessKeyId:     aws.String("key"),
+				SecretAccessKey: aws.String("secret"),
+				SessionToken:    aws.String("token"),
+				Expiration:      aws.Time(time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)),
+			},
+			Region: "eu-central-1",
+		}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq("one"), gomock.Eq(rules)).Return(&rules[0], nil)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(1800))).Return(credentials, nil)
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "text/x-shellscript"},
+			Query:   auth.EventQuery{Role: "one", Duration: "1800"},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, "export AWS_ACCESS_KEY_ID=\"key\"\n"+
+			"export AWS_SECRET_ACCESS_KEY=\"secret\"\n"+
+			"export AWS_SESSION_TOKEN=\"token\"\n"+
+			"export AWS_CREDENTIAL_EXPIRATION=\"2024-01-01T12:30:00Z\"\n"+
+			"export AWS_REGION=\"eu-central-1\"\n"+
+			"export AWS_DEFAULT_REGION=\"eu-central-1\"\n", response.Body)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+	})
+
+	t.Run("invalid duration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		handler := auth.NewHandler(mock.NewMockAwsConsumerInterface(ctrl), mock.NewMockTokenValidatorInterface(ctrl), nil)
+		response, err := handler(ctx, auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token"},
+			Query:   auth.EventQuery{Role: "one", Duration: "1h"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "invalid duration", response.Body)
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	})
+
+	t.Run("keys unavailable", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(nil, fmt.Errorf("%w for issuer %q", auth.ErrKeysUnavailable, "issuer"))
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
+		consumer.EXPECT().Rules().Return(nil)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: "one"},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	})
+
+	t.Run("token replayed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		claims := auth.Claims{ClaimsJSON: []byte("{\"jti\": \"1\"}"),
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Issuer:  "https://gitlab.com",
+				Subject: "hans",
+				ID:      "1",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
+		consumer.EXPECT().Rules().Return(nil)
+
+		replayStore := mock.NewMockReplayStore(ctrl)
+		replayStore.EXPECT().MarkUsed(gomock.Any(), gomock.Eq("jti:https://gitlab.com:1"), gomock.Any()).Return(auth.ErrTokenReplayed)
+
+		handler := auth.NewHandler(consumer, validator, replayStore)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: "one"},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+		assert.Equal(t, auth.ErrTokenReplayed.Error(), response.Body)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		claims := auth.Claims{ClaimsJSON: []byte("{\"namespace_id\": \"1\"}"),
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq("one"), gomock.Any()).Return(nil, auth.ErrAccessDenied)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
+		consumer.EXPECT().Rules().Return(nil)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: "one"},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	})
+
+	t.Run("token expires too soon", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		rules := []auth.Rule{{
+			Role:        "one",
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues,
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq("one"), gomock.Eq(rules)).Return(&rules[0], nil)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("one")).Return(nil, nil)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(nil, fmt.Errorf("%w, 300 seconds remaining", auth.ErrTokenExpiresTooSoon))
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: "one"},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("multiple roles - json", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		roleOne := "arn:aws:iam::123456789012:role/one"
+		roleTwo := "arn:aws:iam::123456789012:role/two,b"
+		rules := []auth.Rule{{
+			Role:        roleOne,
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues,
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil).Times(1)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq(roleOne), gomock.Eq(rules)).Return(&rules[0], nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq(roleTwo), gomock.Eq(rules)).Return(nil, auth.ErrAccessDenied)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(roleOne)).Return(nil, nil)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(roleTwo)).Return(nil, nil)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq("three")).Return(nil, fmt.Errorf("invalid role"))
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{Credentials: &sts.Credentials{AccessKeyId: aws.String("key")}}, nil)
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: roleOne + "," + roleTwo},
+			Body:    "{\"roles\": [\"three\", \"" + roleOne + "\"]}",
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.JSONEq(t, `{
+			"arn:aws:iam::123456789012:role/one": {"StatusCode": 200, "Credentials": {"AccessKeyId": "key", "Expiration": null, "SecretAccessKey": null, "SessionToken": null}},
+			"arn:aws:iam::123456789012:role/two,b": {"StatusCode": 403, "Error": "access denied"},
+			"three": {"StatusCode": 400, "Error": "invalid role"}
+		}`, response.Body)
+	})
+
+	t.Run("role lookup unavailable", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		roleOne := "arn:aws:iam::123456789012:role/one"
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(roleOne)).Return(nil, fmt.Errorf("%w: throttled", auth.ErrRoleLookupUnavailable))
+
+		handler := auth.NewHandler(consumer, mock.NewMockTokenValidatorInterface(ctrl), nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: roleOne},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	})
+
+	t.Run("role lookup unavailable for one of several roles", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		roleOne := "arn:aws:iam::123456789012:role/one"
+		roleTwo := "arn:aws:iam::123456789012:role/two"
+		rules := []auth.Rule{{
+			Role:        roleOne,
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues,
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq(roleOne), gomock.Eq(rules)).Return(&rules[0], nil)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(roleOne)).Return(nil, nil)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(roleTwo)).Return(nil, fmt.Errorf("%w: throttled", auth.ErrRoleLookupUnavailable))
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{Credentials: &sts.Credentials{AccessKeyId: aws.String("key")}}, nil)
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Body:    "{\"roles\": [\"" + roleOne + "\", \"" + roleTwo + "\"]}",
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.JSONEq(t, `{
+			"arn:aws:iam::123456789012:role/one": {"StatusCode": 200, "Credentials": {"AccessKeyId": "key", "Expiration": null, "SecretAccessKey": null, "SessionToken": null}},
+			"arn:aws:iam::123456789012:role/two": {"StatusCode": 503, "Error": "role lookup is currently unavailable: throttled"}
+		}`, response.Body)
+	})
+
+	t.Run("single role with comma", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		role := "arn:aws:iam::123456789012:role/deploy,prod"
+		rules := []auth.Rule{{
+			Role:        role,
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues,
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Eq(role), gomock.Eq(rules)).Return(&rules[0], nil)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Eq(role)).Return(nil, nil)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{Credentials: &sts.Credentials{}}, nil)
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers: auth.EventHeaders{Authorization: "token", Accept: "application/json"},
+			Query:   auth.EventQuery{Role: role},
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "{\"AccessKeyId\":null,\"Expiration\":null,\"SecretAccessKey\":null,\"SessionToken\":null}", response.Body)
+	})
+
+	t.Run("multiple roles - profiles", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		roleOne := "arn:aws:iam::123456789012:role/deploy"
+		roleTwo := "arn:aws:iam::210987654321:role/deploy"
+		rules := []auth.Rule{{
+			Role:        "arn:aws:iam::*:role/deploy",
+			Region:      "eu-central-1",
+			ClaimValues: []byte("{\"namespace_id\": \"1\"}"),
+		}}
+
+		claims := auth.Claims{ClaimsJSON: rules[0].ClaimValues,
+			RegisteredClaims: &jwt.RegisteredClaims{
+				Subject: "hans",
+			}}
+
+		validator := mock.NewMockTokenValidatorInterface(ctrl)
+		validator.EXPECT().RetrieveClaimsFromToken(gomock.Any(), gomock.Eq("token")).Return(&claims, nil)
+		validator.EXPECT().ValidateClaimsForRule(gomock.Any(), gomock.Eq(&claims), gomock.Any(), gomock.Eq(rules)).Return(&rules[0], nil).Times(2)
+
+		consumer := mock.NewMockAwsConsumerInterface(ctrl)
+		consumer.EXPECT().RetrieveRulesFromRoleTags(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+		consumer.EXPECT().AssumeRole(gomock.Any(), gomock.Eq(&rules[0]), gomock.Eq(&claims), gomock.Eq(int64(0))).Return(&auth.Credentials{
+			Credentials: &sts.Credentials{
+				AccessKeyId:     aws.String("key"),
+				SecretAccessKey: aws.String("secret"),
+				SessionToken:    aws.String("session"),
+			},
+			Region: "eu-central-1",
+		}, nil).Times(2)
+		consumer.EXPECT().Rules().Return(rules)
+
+		handler := auth.NewHandler(consumer, validator, nil)
+		event := auth.Event{
+			Headers:         auth.EventHeaders{Authorization: "token", Accept: "text/x-shellscript"},
+			Body:            base64.StdEncoding.EncodeToString([]byte("{\"roles\": [\"" + roleOne + "\", \"" + roleTwo + "\"]}")),
+			IsBase64Encoded: true,
+		}
+		response, err := handler(ctx, event)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Contains(t, response.Body, "aws configure set aws_access_key_id \"key\" --profile \"123456789012-deploy\"\n")
+		assert.Contains(t, response.Body, "aws configure set aws_session_token \"session\" --profile \"210987654321-deploy\"\n")
+		assert.Contains(t, response.Body, "aws configure set region \"eu-central-1\" --profile \"210987654321-deploy\"\n")
+	})
+}
+
+func TestRespondProfiles(t *testing.T) {
+	response, err := auth.RespondProfiles(context.Background(), map[string]auth.RoleResult{
+		"x\ntouch /tmp/pwn": {StatusCode: http.StatusBadRequest, Error: "invalid role \"x\ntouch /tmp/pwn\"\r"},
+		"arn:aws:iam::123456789012:role/deploy": {StatusCode: http.StatusOK, Credentials: &auth.Credentials{Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("key"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("session"),
+		}}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "# arn:aws:iam::123456789012:role/deploy\n"+
+		"aws configure set aws_access_key_id \"key\" --profile \"deploy\"\n"+
+		"aws configure set aws_secret_access_key \"secret\" --profile \"deploy\"\n"+
+		"aws configure set aws_session_token \"session\" --profile \"deploy\"\n"+
+		"# x touch /tmp/pwn: 400 invalid role \"x touch /tmp/pwn\" \n", response.Body)
+}
+
+func TestProfileNames(t *testing.T) {
+	profiles := auth.ProfileNames([]string{
+		"arn:aws:iam::123456789012:role/ci/deploy",
+		"arn:aws:iam::123456789012:role/read",
+		"arn:aws:iam::210987654321:role/read",
+		"some role",
+	})
+	assert.Equal(t, map[string]string{
+		"arn:aws:iam::123456789012:role/ci/deploy": "deploy",
+		"arn:aws:iam::123456789012:role/read":      "123456789012-read",
+		"arn:aws:iam::210987654321:role/read":      "210987654321-read",
+		"some role":                                "some_role",
+	}, profiles)
 }
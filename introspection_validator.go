@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrIntrospectionUnavailable is returned if the introspection endpoint could not be reached
+var ErrIntrospectionUnavailable = errors.New("token introspection is currently unavailable")
+
+// defaultIntrospectionTimeout limits every request to the introspection endpoint
+const defaultIntrospectionTimeout = 10 * time.Second
+
+// IntrospectionConfig holds the settings of an OAuth2 token introspection endpoint (RFC 7662)
+type IntrospectionConfig struct {
+	Endpoint     string `json:"endpoint"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// NewIntrospectionValidator creates a new IntrospectionValidator for the given endpoint
+func NewIntrospectionValidator(config IntrospectionConfig) (*IntrospectionValidator, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("introspection endpoint is required")
+	}
+	return &IntrospectionValidator{
+		config: config,
+		client: &http.Client{Timeout: defaultIntrospectionTimeout},
+	}, nil
+}
+
+// IntrospectionValidator implements a TokenValidatorInterface validating opaque tokens
+// through the introspection endpoint of the issuer
+type IntrospectionValidator struct {
+	ClaimsMatcher
+	config IntrospectionConfig
+	client *http.Client
+}
+
+// RetrieveClaimsFromToken introspects the token and turns the response of an active token into Claims
+func (i *IntrospectionValidator) RetrieveClaimsFromToken(ctx context.Context, tokenInput string) (*Claims, error) {
+	form := url.Values{}
+	form.Set("token", tokenInput)
+	form.Set("token_type_hint", "access_token")
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, i.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if i.config.ClientID != "" {
+		request.SetBasicAuth(url.QueryEscape(i.config.ClientID), url.QueryEscape(i.config.ClientSecret))
+	}
+
+	response, err := i.client.Do(request)
+	if err != nil {
+		Logger(ctx).Warnf("Failed to introspect token: %v", err)
+		return nil, ErrIntrospectionUnavailable
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		Logger(ctx).Warnf("Failed to introspect token: unexpected status code %d", response.StatusCode)
+		return nil, ErrIntrospectionUnavailable
+	}
+
+	var claimsJSON json.RawMessage
+	if err := json.NewDecoder(response.Body).Decode(&claimsJSON); err != nil {
+		return nil, fmt.Errorf("error decoding introspection response: %s", err)
+	}
+
+	var status struct {
+		Active bool `json:"active"`
+	}
+	if err := json.Unmarshal(claimsJSON, &status); err != nil {
+		return nil, fmt.Errorf("error decoding introspection response: %s", err)
+	}
+	if !status.Active {
+		return nil, fmt.Errorf("token is not active")
+	}
+
+	registeredClaims := &jwt.RegisteredClaims{}
+	if err := json.Unmarshal(claimsJSON, registeredClaims); err != nil {
+		return nil, fmt.Errorf("error decoding introspection response: %s", err)
+	}
+	if err := registeredClaims.Valid(); err != nil {
+		return nil, err
+	}
+
+	return &Claims{
+		ClaimsJSON:       claimsJSON,
+		RegisteredClaims: registeredClaims,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestIntrospectionValidator_RetrieveClaimsFromToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "token_auth" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Error parsing form: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostForm.Get("token") {
+		case "active":
+			_, _ = fmt.Fprintf(w, "{\"active\": true, \"sub\": \"hans\", \"iss\": \"https://idp.example.com\", \"aud\": \"token_auth\", \"exp\": %d, \"groups\": \"deployers\"}", time.Now().Add(time.Hour).Unix())
+		case "expired":
+			_, _ = w.Write([]byte("{\"active\": true, \"sub\": \"hans\", \"exp\": 1619006906}"))
+		default:
+			_, _ = w.Write([]byte("{\"active\": false}"))
+		}
+	}))
+	defer server.Close()
+
+	validator, err := auth.NewIntrospectionValidator(auth.IntrospectionConfig{
+		Endpoint:     server.URL,
+		ClientID:     "token_auth",
+		ClientSecret: "secret",
+	})
+	assert.NoError(t, err)
+
+	t.Run("passes active token", func(t *testing.T) {
+		claims, err := validator.RetrieveClaimsFromToken(context.TODO(), "active")
+		assert.NoError(t, err)
+		assert.Equal(t, "hans", claims.RegisteredClaims.Subject)
+		assert.True(t, validator.MatchClaims(context.TODO(), claims, []byte("{\"groups\": \"deployers\"}")))
+	})
+
+	t.Run("breaks on inactive token", func(t *testing.T) {
+		_, err := validator.RetrieveClaimsFromToken(context.TODO(), "revoked")
+		if err == nil || !strings.Contains(err.Error(), "not active") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on expired token", func(t *testing.T) {
+		_, err := validator.RetrieveClaimsFromToken(context.TODO(), "expired")
+		if err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on wrong client credentials", func(t *testing.T) {
+		validator, err := auth.NewIntrospectionValidator(auth.IntrospectionConfig{
+			Endpoint:     server.URL,
+			ClientID:     "token_auth",
+			ClientSecret: "wrong",
+		})
+		assert.NoError(t, err)
+		_, err = validator.RetrieveClaimsFromToken(context.TODO(), "active")
+		assert.ErrorIs(t, err, auth.ErrIntrospectionUnavailable)
+	})
+
+	t.Run("breaks on missing endpoint", func(t *testing.T) {
+		_, err := auth.NewIntrospectionValidator(auth.IntrospectionConfig{})
+		assert.Error(t, err)
+	})
+}
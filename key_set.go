@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MicahParks/keyfunc"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrKeysUnavailable is returned as long as no key set of the issuer could be retrieved
+var ErrKeysUnavailable = errors.New("signing keys are currently unavailable")
+
+const (
+	defaultRefreshInterval  = time.Hour
+	defaultRefreshRateLimit = time.Minute
+	defaultRefreshTimeout   = 10 * time.Second
+)
+
+// RefreshOptions configures how remote key sets are fetched and refreshed
+type RefreshOptions struct {
+	// Interval is the duration after which the key set is refreshed in the background
+	Interval time.Duration
+	// RateLimit is the minimal duration between two fetches caused by failures or unknown key ids
+	RateLimit time.Duration
+	// Timeout limits every single HTTP request
+	Timeout time.Duration
+}
+
+// withDefaults fills all unset options
+func (o RefreshOptions) withDefaults() RefreshOptions {
+	if o.Interval <= 0 {
+		o.Interval = defaultRefreshInterval
+	}
+	if o.RateLimit <= 0 {
+		o.RateLimit = defaultRefreshRateLimit
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultRefreshTimeout
+	}
+	return o
+}
+
+// keySource provides the key set of an issuer together with the signing algorithms it announced
+type keySource interface {
+	get(ctx context.Context) (*keyfunc.JWKS, []string, error)
+}
+
+// staticKeySet holds a key set which is part of the configuration
+type staticKeySet struct {
+	jwks *keyfunc.JWKS
+}
+
+func newStaticKeySet(document json.RawMessage) (*staticKeySet, error) {
+	jwks, err := keyfunc.NewJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	return &staticKeySet{jwks: jwks}, nil
+}
+
+func (s *staticKeySet) get(ctx context.Context) (*keyfunc.JWKS, []string, error) {
+	return s.jwks, nil, nil
+}
+
+// remoteKeySet lazily fetches the key set of an issuer, either from the configured
+// jwks url or from the url announced in the OIDC discovery document. Once fetched,
+// keyfunc refreshes the keys in the background and keeps the last known good set on errors.
+type remoteKeySet struct {
+	issuer  string
+	jwksURL string
+	options RefreshOptions
+	client  *http.Client
+
+	mutex       sync.Mutex
+	jwks        *keyfunc.JWKS
+	algorithms  []string
+	lastAttempt time.Time
+	stopped     bool
+}
+
+func newRemoteKeySet(issuer, jwksURL string, options RefreshOptions) *remoteKeySet {
+	options = options.withDefaults()
+	return &remoteKeySet{
+		issuer:  issuer,
+		jwksURL: jwksURL,
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+	}
+}
+
+// get returns the key set and the signing algorithms announced by the issuer, fetching them on first use
+func (r *remoteKeySet) get(ctx context.Context) (*keyfunc.JWKS, []string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.jwks != nil {
+		return r.jwks, r.algorithms, nil
+	}
+	if r.stopped {
+		return nil, nil, fmt.Errorf("%w for issuer %q", ErrKeysUnavailable, r.issuer)
+	}
+	if !r.lastAttempt.IsZero() && time.Since(r.lastAttempt) < r.options.RateLimit {
+		return nil, nil, fmt.Errorf("%w for issuer %q", ErrKeysUnavailable, r.issuer)
+	}
+	r.lastAttempt = time.Now()
+
+	jwksURL := r.jwksURL
+	var algorithms []string
+	if jwksURL == "" {
+		Logger(ctx).Debugf("Using OIDC discovery for issuer %q", r.issuer)
+		metadata, err := DiscoverProvider(ctx, r.client, r.issuer)
+		if err != nil {
+			Logger(ctx).Warnf("Failed to discover the OpenID configuration: %v", err)
+			return nil, nil, fmt.Errorf("%w for issuer %q", ErrKeysUnavailable, r.issuer)
+		}
+		jwksURL = metadata.JwksURI
+		algorithms = metadata.IDTokenSigningAlgValuesSupported
+	}
+
+	Logger(ctx).Debugf("Using %s for JWK retrival of issuer %q", jwksURL, r.issuer)
+	jwks, err := keyfunc.Get(jwksURL, keyfunc.Options{
+		Client:            r.client,
+		RefreshInterval:   r.options.Interval,
+		RefreshRateLimit:  r.options.RateLimit,
+		RefreshTimeout:    r.options.Timeout,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			log.Warnf("Failed to refresh the JWKS of issuer %q, keeping the last known keys: %v", r.issuer, err)
+		},
+	})
+	if err != nil {
+		Logger(ctx).Warnf("Failed to get the JWKS from %s: %v", jwksURL, err)
+		return nil, nil, fmt.Errorf("%w for issuer %q", ErrKeysUnavailable, r.issuer)
+	}
+
+	r.jwks = jwks
+	r.algorithms = algorithms
+	return r.jwks, r.algorithms, nil
+}
+
+// stop ends the background refresh of the key set, a stopped key set is not fetched anymore
+func (r *remoteKeySet) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.stopped = true
+	if r.jwks != nil {
+		r.jwks.EndBackground()
+	}
+}
@@ -9,7 +9,6 @@ import (
 	reflect "reflect"
 	auth "token_authorizer"
 
-	sts "github.com/aws/aws-sdk-go/service/sts"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -37,18 +36,18 @@ func (m *MockAwsConsumerInterface) EXPECT() *MockAwsConsumerInterfaceMockRecorde
 }
 
 // AssumeRole mocks base method.
-func (m *MockAwsConsumerInterface) AssumeRole(ctx context.Context, rule *auth.Rule, name string) (*sts.Credentials, error) {
+func (m *MockAwsConsumerInterface) AssumeRole(ctx context.Context, rule *auth.Rule, claims *auth.Claims, requestedDuration int64) (*auth.Credentials, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AssumeRole", ctx, rule, name)
-	ret0, _ := ret[0].(*sts.Credentials)
+	ret := m.ctrl.Call(m, "AssumeRole", ctx, rule, claims, requestedDuration)
+	ret0, _ := ret[0].(*auth.Credentials)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AssumeRole indicates an expected call of AssumeRole.
-func (mr *MockAwsConsumerInterfaceMockRecorder) AssumeRole(ctx, rule, name interface{}) *gomock.Call {
+func (mr *MockAwsConsumerInterfaceMockRecorder) AssumeRole(ctx, rule, claims, requestedDuration interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssumeRole", reflect.TypeOf((*MockAwsConsumerInterface)(nil).AssumeRole), ctx, rule, name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssumeRole", reflect.TypeOf((*MockAwsConsumerInterface)(nil).AssumeRole), ctx, rule, claims, requestedDuration)
 }
 
 // BoundAudience mocks base method.
@@ -79,6 +78,34 @@ func (mr *MockAwsConsumerInterfaceMockRecorder) BoundIssuer() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BoundIssuer", reflect.TypeOf((*MockAwsConsumerInterface)(nil).BoundIssuer))
 }
 
+// Introspection mocks base method.
+func (m *MockAwsConsumerInterface) Introspection() *auth.IntrospectionConfig {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Introspection")
+	ret0, _ := ret[0].(*auth.IntrospectionConfig)
+	return ret0
+}
+
+// Introspection indicates an expected call of Introspection.
+func (mr *MockAwsConsumerInterfaceMockRecorder) Introspection() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Introspection", reflect.TypeOf((*MockAwsConsumerInterface)(nil).Introspection))
+}
+
+// Issuers mocks base method.
+func (m *MockAwsConsumerInterface) Issuers() []auth.IssuerConfig {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Issuers")
+	ret0, _ := ret[0].([]auth.IssuerConfig)
+	return ret0
+}
+
+// Issuers indicates an expected call of Issuers.
+func (mr *MockAwsConsumerInterfaceMockRecorder) Issuers() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Issuers", reflect.TypeOf((*MockAwsConsumerInterface)(nil).Issuers))
+}
+
 // JwksURL mocks base method.
 func (m *MockAwsConsumerInterface) JwksURL() string {
 	m.ctrl.T.Helper()
@@ -107,6 +134,20 @@ func (mr *MockAwsConsumerInterfaceMockRecorder) ReadConfiguration() *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadConfiguration", reflect.TypeOf((*MockAwsConsumerInterface)(nil).ReadConfiguration))
 }
 
+// RefreshOptions mocks base method.
+func (m *MockAwsConsumerInterface) RefreshOptions() auth.RefreshOptions {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RefreshOptions")
+	ret0, _ := ret[0].(auth.RefreshOptions)
+	return ret0
+}
+
+// RefreshOptions indicates an expected call of RefreshOptions.
+func (mr *MockAwsConsumerInterfaceMockRecorder) RefreshOptions() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RefreshOptions", reflect.TypeOf((*MockAwsConsumerInterface)(nil).RefreshOptions))
+}
+
 // RetrieveRulesFromRoleTags mocks base method.
 func (m *MockAwsConsumerInterface) RetrieveRulesFromRoleTags(ctx context.Context, role string) ([]auth.Rule, error) {
 	m.ctrl.T.Helper()
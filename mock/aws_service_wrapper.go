@@ -37,33 +37,48 @@ func (m *MockAwsServiceWrapperInterface) EXPECT() *MockAwsServiceWrapperInterfac
 }
 
 // AssumeRole mocks base method.
-func (m *MockAwsServiceWrapperInterface) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+func (m *MockAwsServiceWrapperInterface) AssumeRole(region string, sourceCredentials *sts.Credentials, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AssumeRole", input)
+	ret := m.ctrl.Call(m, "AssumeRole", region, sourceCredentials, input)
 	ret0, _ := ret[0].(*sts.AssumeRoleOutput)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AssumeRole indicates an expected call of AssumeRole.
-func (mr *MockAwsServiceWrapperInterfaceMockRecorder) AssumeRole(input interface{}) *gomock.Call {
+func (mr *MockAwsServiceWrapperInterfaceMockRecorder) AssumeRole(region, sourceCredentials, input interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssumeRole", reflect.TypeOf((*MockAwsServiceWrapperInterface)(nil).AssumeRole), input)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssumeRole", reflect.TypeOf((*MockAwsServiceWrapperInterface)(nil).AssumeRole), region, sourceCredentials, input)
+}
+
+// GetCallerIdentity mocks base method.
+func (m *MockAwsServiceWrapperInterface) GetCallerIdentity() (*sts.GetCallerIdentityOutput, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCallerIdentity")
+	ret0, _ := ret[0].(*sts.GetCallerIdentityOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCallerIdentity indicates an expected call of GetCallerIdentity.
+func (mr *MockAwsServiceWrapperInterfaceMockRecorder) GetCallerIdentity() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCallerIdentity", reflect.TypeOf((*MockAwsServiceWrapperInterface)(nil).GetCallerIdentity))
 }
 
 // GetRole mocks base method.
-func (m *MockAwsServiceWrapperInterface) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+func (m *MockAwsServiceWrapperInterface) GetRole(readerRole string, input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetRole", input)
+	ret := m.ctrl.Call(m, "GetRole", readerRole, input)
 	ret0, _ := ret[0].(*iam.GetRoleOutput)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetRole indicates an expected call of GetRole.
-func (mr *MockAwsServiceWrapperInterfaceMockRecorder) GetRole(input interface{}) *gomock.Call {
+func (mr *MockAwsServiceWrapperInterfaceMockRecorder) GetRole(readerRole, input interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRole", reflect.TypeOf((*MockAwsServiceWrapperInterface)(nil).GetRole), input)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRole", reflect.TypeOf((*MockAwsServiceWrapperInterface)(nil).GetRole), readerRole, input)
 }
 
 // GetS3Object mocks base method.
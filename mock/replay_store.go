@@ -0,0 +1,50 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: ../replay_store.go
+
+// Package mock is a generated GoMock package.
+package mock
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockReplayStore is a mock of ReplayStore interface.
+type MockReplayStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockReplayStoreMockRecorder
+}
+
+// MockReplayStoreMockRecorder is the mock recorder for MockReplayStore.
+type MockReplayStoreMockRecorder struct {
+	mock *MockReplayStore
+}
+
+// NewMockReplayStore creates a new mock instance.
+func NewMockReplayStore(ctrl *gomock.Controller) *MockReplayStore {
+	mock := &MockReplayStore{ctrl: ctrl}
+	mock.recorder = &MockReplayStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReplayStore) EXPECT() *MockReplayStoreMockRecorder {
+	return m.recorder
+}
+
+// MarkUsed mocks base method.
+func (m *MockReplayStore) MarkUsed(ctx context.Context, key string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkUsed", ctx, key, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkUsed indicates an expected call of MarkUsed.
+func (mr *MockReplayStoreMockRecorder) MarkUsed(ctx, key, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkUsed", reflect.TypeOf((*MockReplayStore)(nil).MarkUsed), ctx, key, expiresAt)
+}
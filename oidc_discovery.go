@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// discoveryPath is the well-known location of the OpenID provider configuration
+const discoveryPath = "/.well-known/openid-configuration"
+
+// ProviderMetadata holds the parts of the OpenID provider configuration used for token validation
+type ProviderMetadata struct {
+	Issuer                           string   `json:"issuer"`
+	JwksURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// DiscoverProvider fetches the OpenID configuration of the given issuer and checks that it belongs to this issuer
+func DiscoverProvider(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	discoveryURL := strings.TrimSuffix(issuer, "/") + discoveryPath
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", discoveryURL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch %s: unexpected status code %d", discoveryURL, response.StatusCode)
+	}
+
+	metadata := &ProviderMetadata{}
+	if err := json.NewDecoder(response.Body).Decode(metadata); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", discoveryURL, err)
+	}
+	if metadata.Issuer != issuer {
+		return nil, fmt.Errorf("discovered issuer %q does not match the configured issuer %q", metadata.Issuer, issuer)
+	}
+	if metadata.JwksURI == "" {
+		return nil, fmt.Errorf("discovery document of issuer %q contains no jwks_uri", issuer)
+	}
+	return metadata, nil
+}
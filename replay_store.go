@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrTokenReplayed is returned if a token is presented a second time
+var ErrTokenReplayed = errors.New("token has already been used")
+
+// defaultReplayTTL is used to remember tokens which have no expiration time
+const defaultReplayTTL = 24 * time.Hour
+
+// ReplayStore remembers used tokens until they expire
+type ReplayStore interface {
+	// MarkUsed records the token key and returns ErrTokenReplayed if it was recorded before
+	MarkUsed(ctx context.Context, key string, expiresAt time.Time) error
+}
+
+// NewReplayStore creates the ReplayStore selected by the configuration, nil if replay protection is disabled
+func NewReplayStore(config *Config) (ReplayStore, error) {
+	switch config.ReplayProtection {
+	case "":
+		return nil, nil
+	case "memory":
+		return NewMemoryReplayStore(), nil
+	case "dynamodb":
+		if config.ReplayTable == "" {
+			return nil, fmt.Errorf("replay_table is required for dynamodb replay protection")
+		}
+		sess, err := session.NewSession(&aws.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return NewDynamoDBReplayStore(dynamodb.New(sess), config.ReplayTable), nil
+	default:
+		return nil, fmt.Errorf("unknown replay_protection %q", config.ReplayProtection)
+	}
+}
+
+// ReplayKey identifies a token by its issuer and jti, or by a hash of the token if it has no jti
+func ReplayKey(claims *Claims, token string) string {
+	if claims.RegisteredClaims != nil && claims.RegisteredClaims.ID != "" {
+		return fmt.Sprintf("jti:%s:%s", claims.RegisteredClaims.Issuer, claims.RegisteredClaims.ID)
+	}
+	hash := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// ReplayExpiry returns the time until which the token has to be remembered
+func ReplayExpiry(claims *Claims) time.Time {
+	if claims.RegisteredClaims != nil && claims.RegisteredClaims.ExpiresAt != nil {
+		return claims.RegisteredClaims.ExpiresAt.Time
+	}
+	return time.Now().Add(defaultReplayTTL)
+}
+
+// MemoryReplayStore is a ReplayStore which only protects a single lambda instance
+type MemoryReplayStore struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+// NewMemoryReplayStore creates an empty MemoryReplayStore
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{used: map[string]time.Time{}}
+}
+
+// MarkUsed records the token key and returns ErrTokenReplayed if it was recorded before
+func (m *MemoryReplayStore) MarkUsed(ctx context.Context, key string, expiresAt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for usedKey, usedExpiresAt := range m.used {
+		if usedExpiresAt.Before(now) {
+			delete(m.used, usedKey)
+		}
+	}
+	if _, ok := m.used[key]; ok {
+		return ErrTokenReplayed
+	}
+	m.used[key] = expiresAt
+	return nil
+}
+
+// DynamoDBReplayStore is a ReplayStore shared by all lambda instances. The table needs
+// the string hash key "id", "expires_at" can be used as the TTL attribute of the table.
+type DynamoDBReplayStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+}
+
+// NewDynamoDBReplayStore creates a DynamoDBReplayStore writing into the given table
+func NewDynamoDBReplayStore(client dynamodbiface.DynamoDBAPI, table string) *DynamoDBReplayStore {
+	return &DynamoDBReplayStore{
+		client: client,
+		table:  table,
+	}
+}
+
+// MarkUsed records the token key with a conditional put and returns ErrTokenReplayed if it was recorded before
+func (d *DynamoDBReplayStore) MarkUsed(ctx context.Context, key string, expiresAt time.Time) error {
+	_, err := d.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String(key)},
+			"expires_at": {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+		},
+		// entries are only deleted eventually after their TTL, so expired ones may be overwritten
+		ConditionExpression: aws.String("attribute_not_exists(id) OR expires_at < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrTokenReplayed
+	}
+	if err != nil {
+		return fmt.Errorf("unable to record token usage: %w", err)
+	}
+	return nil
+}
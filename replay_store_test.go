@@ -0,0 +1,111 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestReplayKey(t *testing.T) {
+	t.Run("uses issuer and jti", func(t *testing.T) {
+		claims := &auth.Claims{RegisteredClaims: &jwt.RegisteredClaims{Issuer: "https://gitlab.com", ID: "abcdef"}}
+		assert.Equal(t, "jti:https://gitlab.com:abcdef", auth.ReplayKey(claims, "token"))
+	})
+	t.Run("hashes tokens without jti", func(t *testing.T) {
+		claims := &auth.Claims{RegisteredClaims: &jwt.RegisteredClaims{}}
+		assert.Equal(t, "sha256:3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0", auth.ReplayKey(claims, "token"))
+	})
+}
+
+func TestMemoryReplayStore_MarkUsed(t *testing.T) {
+	ctx := context.TODO()
+	store := auth.NewMemoryReplayStore()
+
+	assert.NoError(t, store.MarkUsed(ctx, "one", time.Now().Add(time.Hour)))
+	assert.ErrorIs(t, store.MarkUsed(ctx, "one", time.Now().Add(time.Hour)), auth.ErrTokenReplayed)
+	assert.NoError(t, store.MarkUsed(ctx, "two", time.Now().Add(-time.Second)))
+	assert.NoError(t, store.MarkUsed(ctx, "two", time.Now().Add(time.Hour)))
+}
+
+// newDynamoDBStandIn emulates the conditional PutItem of DynamoDB
+func newDynamoDBStandIn(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	items := map[string]int64{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "DynamoDB_20120810.PutItem" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var input dynamodb.PutItemInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("Error decoding PutItem: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if *input.TableName != "replay" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("{\"__type\":\"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException\",\"message\":\"Requested resource not found\"}"))
+			return
+		}
+		if *input.ConditionExpression != "attribute_not_exists(id) OR expires_at < :now" {
+			t.Errorf("Unexpected PutItem: %v", input)
+		}
+		id := *input.Item["id"].S
+		expiresAt, _ := strconv.ParseInt(*input.Item["expires_at"].N, 10, 64)
+		now, _ := strconv.ParseInt(*input.ExpressionAttributeValues[":now"].N, 10, 64)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if existing, ok := items[id]; ok && existing >= now {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("{\"__type\":\"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException\",\"message\":\"The conditional request failed\"}"))
+			return
+		}
+		items[id] = expiresAt
+		_, _ = w.Write([]byte("{}"))
+	}))
+}
+
+func TestDynamoDBReplayStore_MarkUsed(t *testing.T) {
+	ctx := context.TODO()
+	server := newDynamoDBStandIn(t)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-central-1"),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	store := auth.NewDynamoDBReplayStore(dynamodb.New(sess), "replay")
+
+	t.Run("records first use", func(t *testing.T) {
+		assert.NoError(t, store.MarkUsed(ctx, "one", time.Now().Add(time.Hour)))
+	})
+	t.Run("rejects reuse", func(t *testing.T) {
+		assert.ErrorIs(t, store.MarkUsed(ctx, "one", time.Now().Add(time.Hour)), auth.ErrTokenReplayed)
+	})
+	t.Run("overwrites expired entries", func(t *testing.T) {
+		assert.NoError(t, store.MarkUsed(ctx, "two", time.Now().Add(-time.Hour)))
+		assert.NoError(t, store.MarkUsed(ctx, "two", time.Now().Add(time.Hour)))
+	})
+	t.Run("error handling", func(t *testing.T) {
+		store := auth.NewDynamoDBReplayStore(dynamodb.New(sess), "unknown")
+		err := store.MarkUsed(ctx, "three", time.Now().Add(time.Hour))
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, auth.ErrTokenReplayed)
+	})
+}
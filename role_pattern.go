@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validAccountID describes the ids of AWS accounts
+var validAccountID = regexp.MustCompile(`^\d{12}$`)
+
+// rolePattern translates a role pattern into an anchored regular expression: "*" matches any
+// characters and "?" a single character, both except ":" and "/" so that wildcards stay
+// within the account id or a single segment of the role name
+func rolePattern(pattern string) string {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			expression.WriteString("[^:/]*")
+		case '?':
+			expression.WriteString("[^:/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expression.WriteString("$")
+	return expression.String()
+}
+
+// isRolePattern checks whether the role contains wildcards
+func isRolePattern(role string) bool {
+	return strings.ContainsAny(role, "*?")
+}
+
+// roleCandidates returns the role arns or patterns of the rule, rules with accounts
+// name the role (with its path) within each of these accounts of any partition
+func roleCandidates(role string, accounts []string) []string {
+	if len(accounts) == 0 {
+		return []string{role}
+	}
+	candidates := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		candidates = append(candidates, fmt.Sprintf("arn:*:iam::%s:role/%s", account, role))
+	}
+	return candidates
+}
+
+// matchRolePattern checks the requested role against the role (pattern) of the rule
+func matchRolePattern(role string, accounts []string, requestedRole string) (bool, error) {
+	for _, candidate := range roleCandidates(role, accounts) {
+		if !isRolePattern(candidate) {
+			if candidate == requestedRole {
+				return true, nil
+			}
+			continue
+		}
+		pattern, err := compilePattern(rolePattern, candidate)
+		if err != nil {
+			return false, err
+		}
+		if pattern.MatchString(requestedRole) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchesAnyRole checks whether the role pattern accepts every role of every account, e.g. "*",
+// "arn:aws:iam::*:role/*" or "arn:aws:iam::????????????:role/*/*". Accounts and role names
+// without any literal character are treated as wildcards.
+func matchesAnyRole(role string, accounts []string) bool {
+	if len(accounts) > 0 || !isRolePattern(role) {
+		return false
+	}
+	parts := strings.SplitN(role, ":", 6)
+	if len(parts) < 6 {
+		return strings.Trim(role, "*?/") == ""
+	}
+	name := strings.TrimPrefix(parts[5], "role/")
+	return strings.Trim(parts[4], "*?") == "" && strings.Trim(name, "*?/") == ""
+}
+
+// validateRolePattern checks the accounts and the role pattern of a rule
+func validateRolePattern(rule Rule, allowAnyRole bool) error {
+	for _, account := range rule.Accounts {
+		if !validAccountID.MatchString(account) {
+			return fmt.Errorf("invalid account id %q", account)
+		}
+	}
+	if len(rule.Accounts) > 0 && strings.HasPrefix(rule.Role, "arn:") {
+		return fmt.Errorf("rules with accounts expect a role name instead of an arn")
+	}
+	if !rule.IsDeny() && !allowAnyRole && matchesAnyRole(rule.Role, rule.Accounts) {
+		return fmt.Errorf("role pattern %q matches any role, set allow_any_role to accept it", rule.Role)
+	}
+	return nil
+}
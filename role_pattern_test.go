@@ -0,0 +1,119 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestTokenValidator_ValidateClaimsForRule_RolePattern(t *testing.T) {
+	ctx := context.TODO()
+	claims := &auth.Claims{ClaimsJSON: []byte(`{"namespace_path": "AOEpeople", "project_id": "1093"}`)}
+	tokenValidator := auth.TokenValidator{}
+
+	tests := map[string]struct {
+		Rule    auth.Rule
+		Role    string
+		IsMatch bool
+	}{
+		"01_account_wildcard": {
+			Rule:    auth.Rule{Role: "arn:aws:iam::*:role/deploy-*"},
+			Role:    "arn:aws:iam::123456789012:role/deploy-production",
+			IsMatch: true,
+		},
+		"02_name_mismatch": {
+			Rule:    auth.Rule{Role: "arn:aws:iam::*:role/deploy-*"},
+			Role:    "arn:aws:iam::123456789012:role/admin",
+			IsMatch: false,
+		},
+		"03_wildcard_stays_in_segment": {
+			Rule:    auth.Rule{Role: "arn:aws:iam::123456789012:role/deploy-*"},
+			Role:    "arn:aws:iam::123456789012:role/deploy-x/admin",
+			IsMatch: false,
+		},
+		"04_account_list": {
+			Rule:    auth.Rule{Role: "deploy-*", Accounts: []string{"123456789012", "210987654321"}},
+			Role:    "arn:aws:iam::210987654321:role/deploy-staging",
+			IsMatch: true,
+		},
+		"05_account_not_listed": {
+			Rule:    auth.Rule{Role: "deploy-*", Accounts: []string{"123456789012"}},
+			Role:    "arn:aws:iam::210987654321:role/deploy-staging",
+			IsMatch: false,
+		},
+		"06_account_list_with_literal_name": {
+			Rule:    auth.Rule{Role: "deploy", Accounts: []string{"123456789012"}},
+			Role:    "arn:aws:iam::123456789012:role/deploy",
+			IsMatch: true,
+		},
+		"07_template_and_pattern": {
+			Rule:    auth.Rule{Role: "arn:aws:iam::*:role/ci-${claims.project_id}-*"},
+			Role:    "arn:aws:iam::123456789012:role/ci-1093-deploy",
+			IsMatch: true,
+		},
+		"08_single_character": {
+			Rule:    auth.Rule{Role: "arn:aws:iam::123456789012:role/deploy-?"},
+			Role:    "arn:aws:iam::123456789012:role/deploy-12",
+			IsMatch: false,
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			testCase.Rule.ClaimValues = []byte(`{"namespace_path": "AOEpeople"}`)
+			rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, testCase.Role, []auth.Rule{testCase.Rule})
+			assert.NoError(t, err)
+			if testCase.IsMatch {
+				assert.Equal(t, testCase.Role, rule.Role)
+			} else {
+				assert.Nil(t, rule)
+			}
+		})
+	}
+
+	t.Run("deny pattern", func(t *testing.T) {
+		rules := []auth.Rule{
+			{Role: "arn:aws:iam::123456789012:role/deploy", ClaimValues: []byte(`{"namespace_path": "AOEpeople"}`)},
+			{Role: "arn:aws:iam::*:role/*", Effect: auth.EffectDeny, ClaimValues: []byte(`{"project_id": "1093"}`)},
+		}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::123456789012:role/deploy", rules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+}
+
+func TestConfig_Validate_RolePattern(t *testing.T) {
+	tests := map[string]struct {
+		Rule    auth.Rule
+		IsValid bool
+	}{
+		"01_pattern":              {auth.Rule{Role: "arn:aws:iam::*:role/deploy-*"}, true},
+		"02_any_role":             {auth.Rule{Role: "arn:aws:iam::*:role/*"}, false},
+		"03_wildcard":             {auth.Rule{Role: "*"}, false},
+		"04_any_role_in_account":  {auth.Rule{Role: "arn:aws:iam::123456789012:role/*"}, true},
+		"05_any_role_of_accounts": {auth.Rule{Role: "*", Accounts: []string{"123456789012"}}, true},
+		"06_invalid_account":      {auth.Rule{Role: "deploy", Accounts: []string{"1234"}}, false},
+		"07_account_with_arn":     {auth.Rule{Role: "arn:aws:iam::123456789012:role/deploy", Accounts: []string{"123456789012"}}, false},
+		"08_deny_any_role":        {auth.Rule{Role: "arn:aws:iam::*:role/*", Effect: auth.EffectDeny}, true},
+		"09_any_account_digits":   {auth.Rule{Role: "arn:aws:iam::????????????:role/*"}, false},
+		"10_any_role_path":        {auth.Rule{Role: "arn:aws:iam::*:role/*/*"}, false},
+		"11_any_single_letter":    {auth.Rule{Role: "arn:aws:iam::*:role/?*"}, false},
+		"12_account_prefix":       {auth.Rule{Role: "arn:aws:iam::1234????????:role/*"}, true},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := auth.Config{Rules: []auth.Rule{testCase.Rule}}
+			if testCase.IsValid {
+				assert.NoError(t, config.Validate())
+			} else {
+				assert.Error(t, config.Validate())
+			}
+		})
+	}
+
+	t.Run("allow any role", func(t *testing.T) {
+		config := auth.Config{AllowAnyRole: true, Rules: []auth.Rule{{Role: "arn:aws:iam::*:role/*"}}}
+		assert.NoError(t, config.Validate())
+	})
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Limits of session policies as defined by STS
+const (
+	maxSessionPolicyLen = 2048
+	maxPolicyArns       = 10
+)
+
+// validPolicyArn describes the arns of managed policies
+var validPolicyArn = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(\d{12}|aws):policy/[\w+=,.@/-]+$`)
+
+// escapePolicyValue encodes claim values for their use within json strings of a policy. Wildcards
+// and policy variables are rejected, as they would widen the resources of the policy.
+func escapePolicyValue(value string) (string, error) {
+	if strings.ContainsAny(value, "*?$") {
+		return "", fmt.Errorf("value %q is not allowed within a session policy", value)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded[1 : len(encoded)-1]), nil
+}
+
+// validateSessionPolicy checks the session policy template and the policy arns of a rule
+func validateSessionPolicy(rule Rule) error {
+	if len(rule.SessionPolicy) > 0 {
+		if _, err := parsePolicyTemplate(string(rule.SessionPolicy)); err != nil {
+			return err
+		}
+	}
+	if len(rule.PolicyArns) > maxPolicyArns {
+		return fmt.Errorf("at most %d policy arns are allowed", maxPolicyArns)
+	}
+	for _, arn := range rule.PolicyArns {
+		if !validPolicyArn.MatchString(arn) {
+			return fmt.Errorf("invalid policy arn %q", arn)
+		}
+	}
+	return nil
+}
+
+// sessionPolicy renders the session policy of the rule from the claims, the result has to
+// be valid json within the size limit of STS
+func sessionPolicy(rule *Rule, claims *Claims) (*string, error) {
+	if len(rule.SessionPolicy) == 0 {
+		return nil, nil
+	}
+	template, err := parsePolicyTemplate(string(rule.SessionPolicy))
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := template.Render(claims.ClaimsJSON, escapePolicyValue)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render session policy: %w", err)
+	}
+	var policy bytes.Buffer
+	if err := json.Compact(&policy, []byte(rendered)); err != nil {
+		return nil, fmt.Errorf("session policy is no valid json: %w", err)
+	}
+	if policy.Len() > maxSessionPolicyLen {
+		return nil, fmt.Errorf("session policy exceeds %d characters", maxSessionPolicyLen)
+	}
+	return aws.String(policy.String()), nil
+}
+
+// policyArns returns the managed policies of the rule
+func policyArns(rule *Rule) []*sts.PolicyDescriptorType {
+	var descriptors []*sts.PolicyDescriptorType
+	for _, arn := range rule.PolicyArns {
+		descriptors = append(descriptors, &sts.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+	return descriptors
+}
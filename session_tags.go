@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Limits of session tags as defined by STS
+const (
+	maxSessionTags        = 50
+	maxSessionTagKeyLen   = 128
+	maxSessionTagValueLen = 256
+)
+
+// validSessionTagKey describes the keys allowed for session tags
+var validSessionTagKey = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]+$`)
+
+// reservedSessionTagPrefix is reserved by AWS, STS rejects session tag keys starting with it in any case
+const reservedSessionTagPrefix = "aws:"
+
+// invalidSessionTagChars matches all characters which are not allowed within session tag values
+var invalidSessionTagChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
+// escapeSessionTagValue replaces all characters which are not allowed within session tags
+func escapeSessionTagValue(value string) (string, error) {
+	return invalidSessionTagChars.ReplaceAllLiteralString(value, "_"), nil
+}
+
+// validateSessionTags checks the session tag keys and templates of a rule
+func validateSessionTags(rule Rule) error {
+	if len(rule.SessionTags) > maxSessionTags {
+		return fmt.Errorf("at most %d session tags are allowed", maxSessionTags)
+	}
+	for key, value := range rule.SessionTags {
+		if len(key) > maxSessionTagKeyLen || !validSessionTagKey.MatchString(key) {
+			return fmt.Errorf("invalid session tag key %q", key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), reservedSessionTagPrefix) {
+			return fmt.Errorf("session tag key %q uses the reserved prefix %q", key, reservedSessionTagPrefix)
+		}
+		if _, err := claimValueTemplate(value); err != nil {
+			return fmt.Errorf("invalid session tag %q: %w", key, err)
+		}
+	}
+	for _, key := range rule.TransitiveTagKeys {
+		if _, ok := rule.SessionTags[key]; !ok {
+			return fmt.Errorf("transitive tag key %q is no session tag", key)
+		}
+	}
+	return nil
+}
+
+// sessionTags renders the session tags of the rule from the claims, values are sanitized
+// to the characters and the length allowed by STS
+func sessionTags(rule *Rule, claims *Claims) ([]*sts.Tag, error) {
+	var tags []*sts.Tag
+	for key, value := range rule.SessionTags {
+		template, err := claimValueTemplate(value)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := template.Render(claims.ClaimsJSON, escapeSessionTagValue)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render session tag %q: %w", key, err)
+		}
+		if runes := []rune(rendered); len(runes) > maxSessionTagValueLen {
+			rendered = string(runes[:maxSessionTagValueLen])
+		}
+		tags = append(tags, &sts.Tag{Key: aws.String(key), Value: aws.String(rendered)})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return *tags[i].Key < *tags[j].Key
+	})
+	return tags, nil
+}
@@ -0,0 +1,33 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestConfig_Validate_SessionTags(t *testing.T) {
+	tests := map[string]struct {
+		SessionTags map[string]string
+		IsValid     bool
+	}{
+		"01_claim_path":       {map[string]string{"project_path": "project_path"}, true},
+		"02_template":         {map[string]string{"project": "ci-${claims.project_id}"}, true},
+		"03_invalid_key":      {map[string]string{"project path!": "project_path"}, false},
+		"04_reserved_prefix":  {map[string]string{"aws:project": "project_path"}, false},
+		"05_reserved_upper":   {map[string]string{"AWS:project": "project_path"}, false},
+		"06_reserved_mixed":   {map[string]string{"Aws:project": "project_path"}, false},
+		"07_prefix_elsewhere": {map[string]string{"gitlab:aws:project": "project_path"}, true},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := auth.Config{Rules: []auth.Rule{{Role: "arn:aws:iam::123456789012:role/deploy", SessionTags: testCase.SessionTags}}}
+			if testCase.IsValid {
+				assert.NoError(t, config.Validate())
+			} else {
+				assert.Error(t, config.Validate())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/buger/jsonparser"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Template is a string with claim placeholders, e.g. arn:aws:iam::123456789012:role/ci-${claims.project_id}.
+// Placeholders are written as ${claims.path} or ${path}, nested claims are separated by dots.
+type Template struct {
+	source   string
+	segments []templateSegment
+}
+
+// templateSegment is either a literal text or the path of a claim
+type templateSegment struct {
+	literal string
+	claim   []string
+}
+
+// templateEscaper converts a claim value for its use within a rendered template, or rejects it
+type templateEscaper func(value string) (string, error)
+
+// templateCache holds all parsed templates by their source, policyTemplateCache all policy templates
+var templateCache, policyTemplateCache sync.Map
+
+// validTemplateClaim describes the claim paths allowed within placeholders
+var validTemplateClaim = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// ParseTemplate parses the placeholders of a template, every template is only parsed once
+func ParseTemplate(source string) (*Template, error) {
+	return parseTemplate(source, &templateCache, false)
+}
+
+// parsePolicyTemplate parses the placeholders of a session policy, placeholders which are no claim
+// path like the policy variables ${aws:username} or ${aws:PrincipalTag/project} are kept as literal
+func parsePolicyTemplate(source string) (*Template, error) {
+	return parseTemplate(source, &policyTemplateCache, true)
+}
+
+// parseTemplate parses the placeholders of a template, invalid placeholders are either kept
+// as literal or are an error
+func parseTemplate(source string, cache *sync.Map, keepInvalid bool) (*Template, error) {
+	if cached, ok := cache.Load(source); ok {
+		return cached.(*Template), nil
+	}
+	template := &Template{source: source}
+	rest := source
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in template %q", source)
+		}
+		path := strings.TrimPrefix(rest[start+2:start+end], "claims.")
+		if !validTemplateClaim.MatchString(path) {
+			if !keepInvalid {
+				return nil, fmt.Errorf("invalid placeholder %q in template %q", rest[start:start+end+1], source)
+			}
+			template.segments = append(template.segments, templateSegment{literal: rest[:start+end+1]})
+			rest = rest[start+end+1:]
+			continue
+		}
+		if start > 0 {
+			template.segments = append(template.segments, templateSegment{literal: rest[:start]})
+		}
+		template.segments = append(template.segments, templateSegment{claim: strings.Split(path, ".")})
+		rest = rest[start+end+1:]
+	}
+	if rest != "" {
+		template.segments = append(template.segments, templateSegment{literal: rest})
+	}
+	cache.Store(source, template)
+	return template, nil
+}
+
+// claimValueTemplate returns the template of a value which is either a template
+// or the path of a single claim, e.g. "project_path" or "gl-${pipeline_id}"
+func claimValueTemplate(value string) (*Template, error) {
+	if !strings.Contains(value, "${") {
+		value = "${" + value + "}"
+	}
+	return ParseTemplate(value)
+}
+
+// IsStatic checks whether the template contains no placeholders
+func (t *Template) IsStatic() bool {
+	for _, segment := range t.segments {
+		if segment.claim != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// renderedSegment is a rendered part of a template, either a literal or a claim value
+type renderedSegment struct {
+	text    string
+	isClaim bool
+}
+
+// Render replaces all placeholders with the escaped claim values. Missing claims and claims
+// which are no string, number or boolean are an error.
+func (t *Template) Render(claimsJSON []byte, escape templateEscaper) (string, error) {
+	segments, err := t.renderSegments(claimsJSON, escape)
+	if err != nil {
+		return "", err
+	}
+	var rendered strings.Builder
+	for _, segment := range segments {
+		rendered.WriteString(segment.text)
+	}
+	return rendered.String(), nil
+}
+
+// renderSegments renders the literals and claim values of the template separately
+func (t *Template) renderSegments(claimsJSON []byte, escape templateEscaper) ([]renderedSegment, error) {
+	var rendered []renderedSegment
+	for _, segment := range t.segments {
+		if segment.claim == nil {
+			rendered = append(rendered, renderedSegment{text: segment.literal})
+			continue
+		}
+		claim := strings.Join(segment.claim, ".")
+		value, dataType, _, err := jsonparser.Get(claimsJSON, segment.claim...)
+		if err != nil {
+			return nil, fmt.Errorf("claim %s of template %q is missing", claim, t.source)
+		}
+		text := string(value)
+		switch dataType {
+		case jsonparser.String:
+			if text, err = jsonparser.ParseString(value); err != nil {
+				return nil, err
+			}
+		case jsonparser.Number, jsonparser.Boolean:
+		default:
+			return nil, fmt.Errorf("claim %s of template %q is no scalar value", claim, t.source)
+		}
+		escaped, err := escape(text)
+		if err != nil {
+			return nil, fmt.Errorf("claim %s of template %q: %w", claim, t.source, err)
+		}
+		rendered = append(rendered, renderedSegment{text: escaped, isClaim: true})
+	}
+	return rendered, nil
+}
+
+// validRoleNameValue describes claim values which may be used within role arns, these are
+// the characters allowed in role names without the path separator
+var validRoleNameValue = regexp.MustCompile(`^[A-Za-z0-9_+=,.@-]+$`)
+
+// escapeRoleValue rejects claim values which could change the structure of a role arn
+func escapeRoleValue(value string) (string, error) {
+	if !validRoleNameValue.MatchString(value) {
+		return "", fmt.Errorf("value %q is not allowed within a role", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,90 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auth "token_authorizer"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	claims := []byte(`{"project_id": "1093", "runner_id": 12, "ref_protected": true, "user": {"login": "jdoe"}, "path": "a/b", "groups": ["a"]}`)
+	identity := func(value string) (string, error) { return value, nil }
+
+	tests := map[string]struct {
+		Template string
+		Rendered string
+	}{
+		"01_static":        {"arn:aws:iam::123456789012:role/deploy", "arn:aws:iam::123456789012:role/deploy"},
+		"02_claims_prefix": {"role/ci-${claims.project_id}", "role/ci-1093"},
+		"03_short_form":    {"${project_id}-${runner_id}", "1093-12"},
+		"04_nested_claim":  {"user-${claims.user.login}", "user-jdoe"},
+		"05_boolean":       {"protected=${ref_protected}", "protected=true"},
+		"06_slash_value":   {"${path}", "a/b"},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			template, err := auth.ParseTemplate(testCase.Template)
+			assert.NoError(t, err)
+			rendered, err := template.Render(claims, identity)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.Rendered, rendered)
+		})
+	}
+
+	t.Run("missing claim", func(t *testing.T) {
+		template, _ := auth.ParseTemplate("ci-${claims.pipeline_id}")
+		_, err := template.Render(claims, identity)
+		assert.Error(t, err)
+	})
+
+	t.Run("array claim", func(t *testing.T) {
+		template, _ := auth.ParseTemplate("ci-${claims.groups}")
+		_, err := template.Render(claims, identity)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid templates", func(t *testing.T) {
+		for _, source := range []string{"ci-${claims.project_id", "ci-${}", "ci-${claims.}", "ci-${a b}"} {
+			_, err := auth.ParseTemplate(source)
+			assert.Error(t, err, source)
+		}
+	})
+}
+
+func TestTokenValidator_ValidateClaimsForRule_RoleTemplate(t *testing.T) {
+	ctx := context.TODO()
+	rules := []auth.Rule{
+		{
+			Role:        "arn:aws:iam::123456789012:role/ci-${claims.project_id}",
+			ClaimValues: []byte(`{"namespace_path": "AOEpeople"}`),
+		},
+	}
+	tokenValidator := auth.TokenValidator{}
+
+	tests := map[string]struct {
+		Claims  string
+		Role    string
+		IsMatch bool
+	}{
+		"01_rendered_role":      {`{"namespace_path": "AOEpeople", "project_id": "1093"}`, "arn:aws:iam::123456789012:role/ci-1093", true},
+		"02_other_project":      {`{"namespace_path": "AOEpeople", "project_id": "1093"}`, "arn:aws:iam::123456789012:role/ci-1094", false},
+		"03_missing_claim":      {`{"namespace_path": "AOEpeople"}`, "arn:aws:iam::123456789012:role/ci-", false},
+		"04_path_injection":     {`{"namespace_path": "AOEpeople", "project_id": "1093/admin"}`, "arn:aws:iam::123456789012:role/ci-1093/admin", false},
+		"05_account_injection":  {`{"namespace_path": "AOEpeople", "project_id": "x:role/admin"}`, "arn:aws:iam::123456789012:role/ci-x:role/admin", false},
+		"06_claims_not_matched": {`{"namespace_path": "other", "project_id": "1093"}`, "arn:aws:iam::123456789012:role/ci-1093", false},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := &auth.Claims{ClaimsJSON: []byte(testCase.Claims)}
+			rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, testCase.Role, rules)
+			assert.NoError(t, err)
+			if testCase.IsMatch {
+				assert.Equal(t, testCase.Role, rule.Role)
+			} else {
+				assert.Nil(t, rule)
+			}
+		})
+	}
+}
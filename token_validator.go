@@ -1,15 +1,13 @@
 package auth
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/MicahParks/keyfunc"
-	"github.com/buger/jsonparser"
 	"github.com/golang-jwt/jwt/v4"
-	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
 // TokenValidatorInterface interface of validation objects
@@ -19,51 +17,223 @@ type TokenValidatorInterface interface {
 	ValidateClaimsForRule(ctx context.Context, tokenClaims *Claims, requestedRole string, rules []Rule) (*Rule, error)
 }
 
-// NewTokenValidator creates a new TokenValidator for a given system
-func NewTokenValidator(jwksURL, boundIssuer, boundAudience string) *TokenValidator {
-	log.Debugf("Using %s for JWK retrival", jwksURL)
-	jwks, err := keyfunc.Get(jwksURL, keyfunc.Options{})
-	if err != nil {
-		log.Fatalf("Failed to get the JWKS from the given URL.\nError: %v", err)
-	}
+// NewTokenValidator creates a new TokenValidator for a single issuer
+func NewTokenValidator(jwksURL, boundIssuer, boundAudience string) (*TokenValidator, error) {
+	return NewMultiIssuerTokenValidator([]IssuerConfig{{
+		Issuer:        boundIssuer,
+		JwksURL:       jwksURL,
+		BoundAudience: boundAudience,
+	}}, RefreshOptions{})
+}
 
-	validator := &TokenValidator{
-		jwks:          jwks,
-		boundIssuer:   boundIssuer,
-		boundAudience: boundAudience,
+// NewMultiIssuerTokenValidator creates a new TokenValidator accepting tokens of all given issuers,
+// remote key sets are fetched on first use
+func NewMultiIssuerTokenValidator(issuers []IssuerConfig, options RefreshOptions) (*TokenValidator, error) {
+	validator := &TokenValidator{options: options}
+	if err := validator.Reload(issuers); err != nil {
+		return nil, err
 	}
-	return validator
+	return validator, nil
 }
 
 // TokenValidator implements a TokenValidatorInterface validating jwt tokens with a remote server
 type TokenValidator struct {
-	jwks          *keyfunc.JWKS
-	boundIssuer   string
-	boundAudience string
+	ClaimsMatcher
+	mutex   sync.RWMutex
+	options RefreshOptions
+	issuers []*issuerValidator
+}
+
+// issuerValidator holds the key set and settings of a single trusted issuer
+type issuerValidator struct {
+	config IssuerConfig
+	keys   keySource
+}
+
+// verifyHeader checks the signing algorithm and key id of the token against the allowed values of the issuer
+func (i *issuerValidator) verifyHeader(token *jwt.Token, algorithms []string) error {
+	alg, _ := token.Header["alg"].(string)
+	if len(algorithms) > 0 && !contains(algorithms, alg) {
+		return fmt.Errorf("signing algorithm %q is not allowed for issuer %q", alg, i.config.Issuer)
+	}
+	kid, _ := token.Header["kid"].(string)
+	if len(i.config.AllowedKids) > 0 && !contains(i.config.AllowedKids, kid) {
+		return fmt.Errorf("key id %q is not allowed for issuer %q", kid, i.config.Issuer)
+	}
+	return nil
+}
+
+// verifyTimes validates the time based claims with the leeway and limits configured for the issuer
+func verifyTimes(claims *jwt.RegisteredClaims, config IssuerConfig, now time.Time) error {
+	leeway := time.Duration(config.Leeway) * time.Second
+
+	if config.RequireExpiration && claims.ExpiresAt == nil {
+		return fmt.Errorf("token has no expiration time (exp)")
+	}
+	if !claims.VerifyExpiresAt(now.Add(-leeway), false) {
+		return jwt.ErrTokenExpired
+	}
+	if !claims.VerifyNotBefore(now.Add(leeway), false) {
+		return jwt.ErrTokenNotValidYet
+	}
+	if (config.RequireIssuedAt || config.MaxTokenAge > 0) && claims.IssuedAt == nil {
+		return fmt.Errorf("token has no issued at time (iat)")
+	}
+	if !claims.VerifyIssuedAt(now.Add(leeway), false) {
+		return jwt.ErrTokenUsedBeforeIssued
+	}
+	maxTokenAge := time.Duration(config.MaxTokenAge) * time.Second
+	if config.MaxTokenAge > 0 && claims.IssuedAt.Add(maxTokenAge+leeway).Before(now) {
+		return fmt.Errorf("token is older than the allowed %d seconds", config.MaxTokenAge)
+	}
+	return nil
+}
+
+// contains checks whether the value is part of the list
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload replaces the trusted issuers, static key sets are rebuilt while remote key sets
+// of unchanged issuers are kept and these of removed or changed issuers are stopped
+func (t *TokenValidator) Reload(issuers []IssuerConfig) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	previous := map[string]*remoteKeySet{}
+	for _, issuer := range t.issuers {
+		if remote, ok := issuer.keys.(*remoteKeySet); ok {
+			previous[remote.issuer+" "+remote.jwksURL] = remote
+		}
+	}
+
+	var validators []*issuerValidator
+	used := map[*remoteKeySet]bool{}
+	for _, issuer := range issuers {
+		for _, algorithm := range issuer.AllowedAlgorithms {
+			if jwt.GetSigningMethod(algorithm) == nil || algorithm == "none" {
+				return fmt.Errorf("unsupported signing algorithm %q for issuer %q", algorithm, issuer.Issuer)
+			}
+		}
+		var keys keySource
+		switch {
+		case len(issuer.Jwks) > 0:
+			static, err := newStaticKeySet(issuer.Jwks)
+			if err != nil {
+				return fmt.Errorf("invalid jwks of issuer %q: %w", issuer.Issuer, err)
+			}
+			keys = static
+		case issuer.JwksURL == "" && issuer.Issuer == "":
+			return fmt.Errorf("either jwks, jwks_url or issuer is required")
+		default:
+			remote, ok := previous[issuer.Issuer+" "+issuer.JwksURL]
+			if !ok {
+				remote = newRemoteKeySet(issuer.Issuer, issuer.JwksURL, t.options)
+			}
+			used[remote] = true
+			keys = remote
+		}
+		validators = append(validators, &issuerValidator{
+			config: issuer,
+			keys:   keys,
+		})
+	}
+	for _, remote := range previous {
+		if !used[remote] {
+			remote.stop()
+		}
+	}
+	t.issuers = validators
+	return nil
+}
+
+// Close ends the background refresh of all remote key sets
+func (t *TokenValidator) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, issuer := range t.issuers {
+		if remote, ok := issuer.keys.(*remoteKeySet); ok {
+			remote.stop()
+		}
+	}
+}
+
+// issuerFor selects the validator for the given issuer, an issuer without a
+// bound issuer value accepts tokens of any issuer
+func (t *TokenValidator) issuerFor(issuer string) *issuerValidator {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var fallback *issuerValidator
+	for _, candidate := range t.issuers {
+		if candidate.config.Issuer == issuer {
+			return candidate
+		}
+		if candidate.config.Issuer == "" && fallback == nil {
+			fallback = candidate
+		}
+	}
+	return fallback
 }
 
 // RetrieveClaimsFromToken validate the token and get all included claims
 func (t *TokenValidator) RetrieveClaimsFromToken(ctx context.Context, tokenInput string) (*Claims, error) {
-	tokenClaims, err := jwt.ParseWithClaims(tokenInput, &jwt.MapClaims{}, t.jwks.Keyfunc)
+	unverified, _, err := jwt.NewParser().ParseUnverified(tokenInput, &jwt.RegisteredClaims{})
 	if err != nil {
 		return nil, err
 	}
+	tokenIssuer := unverified.Claims.(*jwt.RegisteredClaims).Issuer
+	issuer := t.issuerFor(tokenIssuer)
+
+	var issuerConfig IssuerConfig
+	if issuer != nil {
+		issuerConfig = issuer.config
+	}
+	if err := verifyTimes(unverified.Claims.(*jwt.RegisteredClaims), issuerConfig, time.Now()); err != nil {
+		return nil, err
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("issuer %q is not allowed", tokenIssuer)
+	}
 
-	token, err := jwt.ParseWithClaims(tokenInput, &jwt.RegisteredClaims{}, t.jwks.Keyfunc)
+	jwks, algorithms, err := issuer.keys.get(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if len(issuer.config.AllowedAlgorithms) > 0 {
+		algorithms = issuer.config.AllowedAlgorithms
+	}
+	if err := issuer.verifyHeader(unverified, algorithms); err != nil {
+		return nil, err
+	}
+	parserOptions := []jwt.ParserOption{jwt.WithoutClaimsValidation()}
+	if len(algorithms) > 0 {
+		parserOptions = append(parserOptions, jwt.WithValidMethods(algorithms))
+	}
 
-	if !token.Valid {
-		return nil, fmt.Errorf("token invalid")
+	tokenClaims, err := jwt.ParseWithClaims(tokenInput, &jwt.MapClaims{}, jwks.Keyfunc, parserOptions...)
+	if err != nil {
+		return nil, err
 	}
 
-	if t.boundIssuer != "" && !token.Claims.(*jwt.RegisteredClaims).VerifyIssuer(t.boundIssuer, true) {
-		return nil, fmt.Errorf("bound issuer %s expected", t.boundIssuer)
+	token, err := jwt.ParseWithClaims(tokenInput, &jwt.RegisteredClaims{}, jwks.Keyfunc, parserOptions...)
+	if err != nil {
+		return nil, err
 	}
 
-	if t.boundAudience != "" && !token.Claims.(*jwt.RegisteredClaims).VerifyAudience(t.boundAudience, true) {
-		return nil, fmt.Errorf("bound audience %s expected", t.boundAudience)
+	if !token.Valid {
+		return nil, fmt.Errorf("token invalid")
+	}
+
+	boundAudience := issuer.config.BoundAudience
+	if boundAudience != "" && !token.Claims.(*jwt.RegisteredClaims).VerifyAudience(boundAudience, true) {
+		return nil, fmt.Errorf("bound audience %s expected", boundAudience)
 	}
 
 	Logger(ctx).Debugf("Raw token: %s", token.Raw)
@@ -79,6 +249,13 @@ func (t *TokenValidator) RetrieveClaimsFromToken(ctx context.Context, tokenInput
 		return nil, fmt.Errorf("error decoding claims section: %s", err)
 	}
 
+	if len(issuer.config.RequiredClaims) > 0 {
+		match, err := MatchClaimsInternal(ctx, claimsJSON, issuer.config.RequiredClaims)
+		if err != nil || !match {
+			return nil, fmt.Errorf("token lacks the required claims of issuer %q", tokenIssuer)
+		}
+	}
+
 	claims := &Claims{
 		ClaimsJSON:       claimsJSON,
 		RegisteredClaims: token.Claims.(*jwt.RegisteredClaims),
@@ -86,69 +263,3 @@ func (t *TokenValidator) RetrieveClaimsFromToken(ctx context.Context, tokenInput
 
 	return claims, nil
 }
-
-// MatchClaimsInternal implements claims matching on the json byte data level
-func MatchClaimsInternal(ctx context.Context, claims []byte, rules []byte) (bool, error) {
-	matches := true
-
-	err := jsonparser.ObjectEach(rules, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
-		keyString := string(key)
-
-		claimsObj, claimsObjDataType, _, err := jsonparser.Get(claims, keyString)
-		//Check for parsing errors
-		if err != nil && claimsObjDataType != jsonparser.NotExist {
-			return err
-		}
-		//Check if rule type matches with claim type
-		if claimsObjDataType != dataType {
-			matches = false
-			return nil
-		}
-
-		switch dataType {
-		case jsonparser.Object:
-			//Check if object matches with rules
-			objMatches, err := MatchClaimsInternal(ctx, claimsObj, value)
-			if err != nil {
-				return err
-			}
-			//Check if object matches
-			if !objMatches {
-				matches = false
-				return nil
-			}
-		case jsonparser.String, jsonparser.Boolean, jsonparser.Number:
-			if !bytes.Equal(claimsObj, value) {
-				matches = false
-				return nil
-			}
-		case jsonparser.Array:
-			return fmt.Errorf("handling for arraytypes not implemented yet")
-		case jsonparser.NotExist, jsonparser.Unknown, jsonparser.Null:
-			return fmt.Errorf("iterated over a key with type %s. This should not happen", dataType.String())
-		}
-
-		return nil
-	})
-	return matches && err == nil, err
-}
-
-// MatchClaims check if all claims from a token are presented within rules
-func (t *TokenValidator) MatchClaims(ctx context.Context, tokenClaims *Claims, ruleClaims []byte) bool {
-	Logger(ctx).Debugf("Rules JSON: %s", ruleClaims)
-	match, err := MatchClaimsInternal(ctx, tokenClaims.ClaimsJSON, ruleClaims)
-	if err != nil {
-		Logger(ctx).Warnf("error matching claims: %s", err)
-	}
-	return match && err == nil
-}
-
-// ValidateClaimsForRule check if
-func (t *TokenValidator) ValidateClaimsForRule(ctx context.Context, tokenClaims *Claims, requestedRole string, rules []Rule) (*Rule, error) {
-	for _, rule := range rules {
-		if strings.Compare(rule.Role, requestedRole) == 0 && t.MatchClaims(ctx, tokenClaims, rule.ClaimValues) {
-			return &rule, nil
-		}
-	}
-	return nil, nil
-}
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -94,7 +95,9 @@ func TestTokenValidator_RetrieveClaimsFromToken(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tokenValidator := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.com", "tolen_validation_test")
+	tokenValidator, err := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.com", "tolen_validation_test")
+	assert.NoError(t, err)
+	t.Cleanup(tokenValidator.Close)
 	t.Run("passes valid token", func(t *testing.T) {
 		signedToken, _ := token.SignedString(privateKey)
 		claims, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
@@ -114,27 +117,33 @@ func TestTokenValidator_RetrieveClaimsFromToken(t *testing.T) {
 	})
 
 	t.Run("passes when bound issuer or audience is empty", func(t *testing.T) {
-		tokenValidator := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "", "")
+		tokenValidator, err := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "", "")
+		assert.NoError(t, err)
+		t.Cleanup(tokenValidator.Close)
 		signedToken, _ := token.SignedString(privateKey)
-		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
 		if err != nil {
 			t.Errorf("Function returned unexpected error: %v", err)
 		}
 	})
 
 	t.Run("breaks on wrong issuer", func(t *testing.T) {
-		tokenValidator := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.org", "tolen_validation_test")
+		tokenValidator, err := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.org", "tolen_validation_test")
+		assert.NoError(t, err)
+		t.Cleanup(tokenValidator.Close)
 		signedToken, _ := token.SignedString(privateKey)
-		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
 		if err == nil || !strings.Contains(err.Error(), "issuer") {
 			t.Errorf("Function returned unexpected error: %v", err)
 		}
 	})
 
 	t.Run("breaks on wrong audience", func(t *testing.T) {
-		tokenValidator := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.com", "wrong")
+		tokenValidator, err := auth.NewTokenValidator(fmt.Sprintf("%s/jwks", server.URL), "https://issuer.example.com", "wrong")
+		assert.NoError(t, err)
+		t.Cleanup(tokenValidator.Close)
 		signedToken, _ := token.SignedString(privateKey)
-		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
 		if err == nil || !strings.Contains(err.Error(), "audience") {
 			t.Errorf("Function returned unexpected error: %v", err)
 		}
@@ -207,6 +216,156 @@ func TestTokenValidator_MatchClaimsInternal(t *testing.T) {
 				Rules:   "{\"foo\": {\"bar\": \"botz\"}}",
 				IsMatch: false,
 			},
+			"06_any_of_match": {
+				Claims:  "{\"ref\": \"develop\"}",
+				Rules:   "{\"ref\": [\"main\", \"develop\"]}",
+				IsMatch: true,
+			},
+			"07_any_of_mismatch": {
+				Claims:  "{\"ref\": \"feature\"}",
+				Rules:   "{\"ref\": [\"main\", \"develop\"]}",
+				IsMatch: false,
+			},
+			"08_contains_match": {
+				Claims:  "{\"aud\": [\"sts.amazonaws.com\", \"token_auth\"]}",
+				Rules:   "{\"aud\": \"token_auth\"}",
+				IsMatch: true,
+			},
+			"09_contains_mismatch": {
+				Claims:  "{\"aud\": [\"sts.amazonaws.com\"]}",
+				Rules:   "{\"aud\": \"token_auth\"}",
+				IsMatch: false,
+			},
+			"10_array_any_of_match": {
+				Claims:  "{\"groups\": [\"developers\", \"qa\"]}",
+				Rules:   "{\"groups\": [\"admins\", \"qa\"]}",
+				IsMatch: true,
+			},
+			"11_contains_all_match": {
+				Claims:  "{\"groups\": [\"developers\", \"deployers\", \"qa\"]}",
+				Rules:   "{\"groups\": {\"contains_all\": [\"deployers\", \"developers\"]}}",
+				IsMatch: true,
+			},
+			"12_contains_all_mismatch": {
+				Claims:  "{\"groups\": [\"developers\", \"qa\"]}",
+				Rules:   "{\"groups\": {\"contains_all\": [\"deployers\", \"developers\"]}}",
+				IsMatch: false,
+			},
+			"13_contains_all_missing_claim": {
+				Claims:  "{\"foo\": \"bar\"}",
+				Rules:   "{\"groups\": {\"contains_all\": [\"deployers\"]}}",
+				IsMatch: false,
+			},
+			"14_any_of_type_mismatch": {
+				Claims:  "{\"project_id\": \"4\"}",
+				Rules:   "{\"project_id\": [4, 5]}",
+				IsMatch: false,
+			},
+			"15_glob_match": {
+				Claims:  "{\"ref\": \"release/1.2\"}",
+				Rules:   "{\"ref\": {\"glob\": \"release/*\"}}",
+				IsMatch: true,
+			},
+			"16_glob_mismatch_across_separator": {
+				Claims:  "{\"ref\": \"release/1.2/hotfix\"}",
+				Rules:   "{\"ref\": {\"glob\": \"release/*\"}}",
+				IsMatch: false,
+			},
+			"17_glob_double_star": {
+				Claims:  "{\"project_path\": \"infra/aws/network\"}",
+				Rules:   "{\"project_path\": {\"glob\": \"infra/**\"}}",
+				IsMatch: true,
+			},
+			"18_regex_match": {
+				Claims:  "{\"project_path\": \"infra/network\"}",
+				Rules:   "{\"project_path\": {\"regex\": \"^infra/.*$\"}}",
+				IsMatch: true,
+			},
+			"19_regex_mismatch": {
+				Claims:  "{\"project_path\": \"apps/infra\"}",
+				Rules:   "{\"project_path\": {\"regex\": \"^infra/.*$\"}}",
+				IsMatch: false,
+			},
+			"20_regex_escaped": {
+				Claims:  "{\"ref\": \"v1.2.3\"}",
+				Rules:   "{\"ref\": {\"regex\": \"^v\\\\d+\\\\.\\\\d+\\\\.\\\\d+$\"}}",
+				IsMatch: true,
+			},
+			"21_regex_array_claim": {
+				Claims:  "{\"groups\": [\"qa\", \"team-infra\"]}",
+				Rules:   "{\"groups\": {\"regex\": \"^team-\"}}",
+				IsMatch: true,
+			},
+			"22_glob_alternatives": {
+				Claims:  "{\"ref\": \"hotfix/login\"}",
+				Rules:   "{\"ref\": [\"main\", {\"glob\": \"hotfix/*\"}]}",
+				IsMatch: true,
+			},
+			"23_between_numeric_string": {
+				Claims:  "{\"project_id\": \"150\"}",
+				Rules:   "{\"project_id\": {\"between\": [100, 200]}}",
+				IsMatch: true,
+			},
+			"24_between_out_of_range": {
+				Claims:  "{\"project_id\": 250}",
+				Rules:   "{\"project_id\": {\"between\": [100, 200]}}",
+				IsMatch: false,
+			},
+			"25_gte_match": {
+				Claims:  "{\"pipeline_id\": \"1255137\"}",
+				Rules:   "{\"pipeline_id\": {\"gte\": 1255137}}",
+				IsMatch: true,
+			},
+			"26_gt_mismatch": {
+				Claims:  "{\"pipeline_id\": 1255137}",
+				Rules:   "{\"pipeline_id\": {\"gt\": \"1255137\"}}",
+				IsMatch: false,
+			},
+			"27_combined_range": {
+				Claims:  "{\"project_id\": 42}",
+				Rules:   "{\"project_id\": {\"gt\": 10, \"lt\": 50}}",
+				IsMatch: true,
+			},
+			"28_time_after": {
+				Claims:  "{\"iat\": 1619003306}",
+				Rules:   "{\"iat\": {\"gt\": \"2021-01-01T00:00:00Z\"}}",
+				IsMatch: true,
+			},
+			"29_time_before": {
+				Claims:  "{\"iat\": 1619003306}",
+				Rules:   "{\"iat\": {\"lte\": \"2021-01-01T00:00:00Z\"}}",
+				IsMatch: false,
+			},
+			"30_non_numeric_claim": {
+				Claims:  "{\"project_id\": \"abc\"}",
+				Rules:   "{\"project_id\": {\"lt\": 100}}",
+				IsMatch: false,
+			},
+			"31_missing_claim": {
+				Claims:  "{\"foo\": \"bar\"}",
+				Rules:   "{\"project_id\": {\"lt\": 100}}",
+				IsMatch: false,
+			},
+			"32_infinity_claim": {
+				Claims:  "{\"project_id\": \"Infinity\"}",
+				Rules:   "{\"project_id\": {\"gt\": 100}}",
+				IsMatch: false,
+			},
+			"33_nan_claim": {
+				Claims:  "{\"project_id\": \"NaN\"}",
+				Rules:   "{\"project_id\": {\"lte\": 100}}",
+				IsMatch: false,
+			},
+			"34_large_id_exact": {
+				Claims:  "{\"project_id\": 12345678901234567}",
+				Rules:   "{\"project_id\": {\"gt\": 12345678901234566}}",
+				IsMatch: true,
+			},
+			"35_large_id_string_exact": {
+				Claims:  "{\"project_id\": \"12345678901234567\"}",
+				Rules:   "{\"project_id\": {\"lt\": 12345678901234567}}",
+				IsMatch: false,
+			},
 		}
 		ctx := context.TODO()
 		for name, testCase := range tests {
@@ -236,6 +395,10 @@ func TestTokenValidator_MatchClaimsInternal(t *testing.T) {
 				Claims: "{\"namespace_id\": \"172\", \"roles\": null}",
 				Rules:  "{\"namespace_id\": \"172\", \"roles\": null}",
 			},
+			"05_contains_all_without_array": {
+				Claims: "{\"groups\": [\"developers\"]}",
+				Rules:  "{\"groups\": {\"contains_all\": \"developers\"}}",
+			},
 		}
 		ctx := context.TODO()
 		for name, testCase := range tests {
@@ -248,6 +411,90 @@ func TestTokenValidator_MatchClaimsInternal(t *testing.T) {
 	})
 }
 
+func TestTokenValidator_MatchClaimsWithOptions(t *testing.T) {
+	tests := map[string]TestCase{
+		"01_number_matches_string": {
+			Claims:  "{\"namespace_id\": \"4\"}",
+			Rules:   "{\"namespace_id\": 4}",
+			IsMatch: true,
+		},
+		"02_string_matches_number": {
+			Claims:  "{\"runner_id\": 12}",
+			Rules:   "{\"runner_id\": \"12.0\"}",
+			IsMatch: true,
+		},
+		"03_bool_matches_string": {
+			Claims:  "{\"ref_protected\": \"true\"}",
+			Rules:   "{\"ref_protected\": true}",
+			IsMatch: true,
+		},
+		"04_any_of_coerced": {
+			Claims:  "{\"project_id\": \"1093\"}",
+			Rules:   "{\"project_id\": [12, 1093]}",
+			IsMatch: true,
+		},
+		"05_array_claim_coerced": {
+			Claims:  "{\"group_ids\": [\"1\", \"2\"]}",
+			Rules:   "{\"group_ids\": 2}",
+			IsMatch: true,
+		},
+		"06_different_value": {
+			Claims:  "{\"namespace_id\": \"4\"}",
+			Rules:   "{\"namespace_id\": 5}",
+			IsMatch: false,
+		},
+		"07_bool_mismatch": {
+			Claims:  "{\"ref_protected\": \"false\"}",
+			Rules:   "{\"ref_protected\": true}",
+			IsMatch: false,
+		},
+		"08_object_not_coerced": {
+			Claims:  "{\"foo\": {\"bar\": \"botz\"}}",
+			Rules:   "{\"foo\": \"botz\"}",
+			IsMatch: false,
+		},
+		"09_strings_not_normalized": {
+			Claims:  "{\"ref\": \"1.0\"}",
+			Rules:   "{\"ref\": \"1\"}",
+			IsMatch: false,
+		},
+		"10_leading_zero_not_coerced": {
+			Claims:  "{\"project_id\": \"0123\"}",
+			Rules:   "{\"project_id\": 123}",
+			IsMatch: false,
+		},
+		"11_exponent_strings_not_normalized": {
+			Claims:  "{\"ref\": \"1e2\"}",
+			Rules:   "{\"ref\": \"100\"}",
+			IsMatch: false,
+		},
+		"12_large_id_exact": {
+			Claims:  "{\"project_id\": \"12345678901234567\"}",
+			Rules:   "{\"project_id\": 12345678901234568}",
+			IsMatch: false,
+		},
+		"13_large_id_match": {
+			Claims:  "{\"project_id\": \"12345678901234567\"}",
+			Rules:   "{\"project_id\": 12345678901234567}",
+			IsMatch: true,
+		},
+	}
+	ctx := context.TODO()
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			matches, err := auth.MatchClaimsWithOptions(ctx, []byte(testCase.Claims), []byte(testCase.Rules), auth.MatchOptions{CoerceTypes: true})
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.IsMatch, matches)
+		})
+	}
+
+	t.Run("strict without coercion", func(t *testing.T) {
+		matches, err := auth.MatchClaimsWithOptions(ctx, []byte("{\"namespace_id\": \"4\"}"), []byte("{\"namespace_id\": 4}"), auth.MatchOptions{})
+		assert.NoError(t, err)
+		assert.False(t, matches)
+	})
+}
+
 func TestTokenValidator_MatchClaims(t *testing.T) {
 	ctx := context.TODO()
 
@@ -275,3 +522,639 @@ func TestTokenValidator_MatchClaims(t *testing.T) {
 		assert.Equal(t, false, result)
 	})
 }
+
+func newTestKey(t *testing.T, kid string) (*rsa.PrivateKey, JWK) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key pair: %v", err)
+	}
+	return privateKey, JWK{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.PublicKey.E)).Bytes()),
+	}
+}
+
+// signTestToken signs a token of the issuer valid for an hour, the extra claims are added to or replace the default claims
+func signTestToken(t *testing.T, issuer, kid string, key *rsa.PrivateKey, extra jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"iss": issuer,
+		"sub": "1234567890",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signedToken, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	return signedToken
+}
+
+func TestTokenValidator_MultipleIssuers(t *testing.T) {
+	gitlabKey, gitlabJWK := newTestKey(t, "gitlab")
+	githubKey, githubJWK := newTestKey(t, "github")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/gitlab/jwks":
+			_ = json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{gitlabJWK}})
+		case "/github/jwks":
+			_ = json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{githubJWK}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{
+		{
+			Issuer:        "https://gitlab.example.com",
+			JwksURL:       fmt.Sprintf("%s/gitlab/jwks", server.URL),
+			BoundAudience: "gitlab_audience",
+		},
+		{
+			Issuer:         "https://github.example.com",
+			JwksURL:        fmt.Sprintf("%s/github/jwks", server.URL),
+			BoundAudience:  "github_audience",
+			RequiredClaims: []byte("{\"repository_owner\": \"AOEpeople\"}"),
+		},
+	}, auth.RefreshOptions{})
+	assert.NoError(t, err)
+	t.Cleanup(tokenValidator.Close)
+
+	t.Run("passes tokens of every configured issuer", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.example.com", "gitlab", gitlabKey, jwt.MapClaims{"aud": []string{"gitlab_audience"}}))
+		assert.NoError(t, err)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://github.example.com", "github", githubKey, jwt.MapClaims{"aud": []string{"github_audience"}, "repository_owner": "AOEpeople"}))
+		assert.NoError(t, err)
+	})
+
+	t.Run("breaks on unknown issuer", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://other.example.com", "gitlab", gitlabKey, jwt.MapClaims{"aud": []string{"gitlab_audience"}}))
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on key of another issuer", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://github.example.com", "gitlab", gitlabKey, jwt.MapClaims{"aud": []string{"github_audience"}, "repository_owner": "AOEpeople"}))
+		assert.Error(t, err)
+	})
+
+	t.Run("breaks on audience of another issuer", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.example.com", "gitlab", gitlabKey, jwt.MapClaims{"aud": []string{"github_audience"}}))
+		if err == nil || !strings.Contains(err.Error(), "audience") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on missing required claims", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://github.example.com", "github", githubKey, jwt.MapClaims{"aud": []string{"github_audience"}, "repository_owner": "someone"}))
+		if err == nil || !strings.Contains(err.Error(), "required claims") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+}
+
+func newTestOIDCServer(t *testing.T, jwk JWK, metadata func(serverURL string) map[string]interface{}) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			err := json.NewEncoder(w).Encode(metadata(server.URL))
+			if err != nil {
+				t.Errorf("Error encoding openid-configuration: %v", err)
+			}
+		case "/oauth/discovery/keys":
+			err := json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+			if err != nil {
+				t.Errorf("Error encoding jwks: %v", err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestTokenValidator_Discovery(t *testing.T) {
+	privateKey, jwk := newTestKey(t, "key-id")
+
+	t.Run("passes valid token with discovered key set", func(t *testing.T) {
+		server := newTestOIDCServer(t, jwk, func(serverURL string) map[string]interface{} {
+			return map[string]interface{}{
+				"issuer":                                serverURL,
+				"jwks_uri":                              serverURL + "/oauth/discovery/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			}
+		})
+		defer server.Close()
+
+		tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{Issuer: server.URL}}, auth.RefreshOptions{})
+		assert.NoError(t, err)
+		t.Cleanup(tokenValidator.Close)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, server.URL, jwk.Kid, privateKey, nil))
+		assert.NoError(t, err)
+	})
+
+	t.Run("breaks on algorithm not announced by the issuer", func(t *testing.T) {
+		server := newTestOIDCServer(t, jwk, func(serverURL string) map[string]interface{} {
+			return map[string]interface{}{
+				"issuer":                                serverURL,
+				"jwks_uri":                              serverURL + "/oauth/discovery/keys",
+				"id_token_signing_alg_values_supported": []string{"ES256"},
+			}
+		})
+		defer server.Close()
+
+		tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{Issuer: server.URL}}, auth.RefreshOptions{})
+		assert.NoError(t, err)
+		t.Cleanup(tokenValidator.Close)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, server.URL, jwk.Kid, privateKey, nil))
+		if err == nil || !strings.Contains(err.Error(), "signing algorithm \"RS256\" is not allowed") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on mismatching discovered issuer", func(t *testing.T) {
+		server := newTestOIDCServer(t, jwk, func(serverURL string) map[string]interface{} {
+			return map[string]interface{}{
+				"issuer":   "https://issuer.example.org",
+				"jwks_uri": serverURL + "/oauth/discovery/keys",
+			}
+		})
+		defer server.Close()
+
+		_, err := auth.DiscoverProvider(context.TODO(), http.DefaultClient, server.URL)
+		if err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Errorf("Function returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("breaks on missing discovery document", func(t *testing.T) {
+		server := newTestOIDCServer(t, jwk, nil)
+		defer server.Close()
+
+		_, err := auth.DiscoverProvider(context.TODO(), http.DefaultClient, server.URL+"/unknown")
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenValidator_KeyAvailability(t *testing.T) {
+	privateKey, jwk := newTestKey(t, "key-id")
+	rotatedKey, rotatedJWK := newTestKey(t, "rotated-key-id")
+
+	var mutex sync.Mutex
+	var keys []JWK
+	var requests int
+	setKeys := func(jwks ...JWK) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		keys = jwks
+	}
+	requestCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if keys == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(JWKSet{Keys: keys})
+	}))
+	defer server.Close()
+
+	tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{
+		Issuer:  "https://issuer.example.com",
+		JwksURL: server.URL,
+	}}, auth.RefreshOptions{Interval: 20 * time.Millisecond, RateLimit: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	t.Cleanup(tokenValidator.Close)
+
+	t.Run("reports unavailable keys during an outage", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://issuer.example.com", jwk.Kid, privateKey, nil))
+		assert.ErrorIs(t, err, auth.ErrKeysUnavailable)
+	})
+
+	t.Run("recovers once the keys are available", func(t *testing.T) {
+		setKeys(jwk)
+		assert.Eventually(t, func() bool {
+			_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://issuer.example.com", jwk.Kid, privateKey, nil))
+			return err == nil
+		}, 5*time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("refreshes on unknown key id", func(t *testing.T) {
+		setKeys(jwk, rotatedJWK)
+		assert.Eventually(t, func() bool {
+			_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://issuer.example.com", rotatedJWK.Kid, rotatedKey, nil))
+			return err == nil
+		}, 5*time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("keeps the last known keys during an outage", func(t *testing.T) {
+		setKeys()
+		failedRefreshes := requestCount() + 2
+		assert.Eventually(t, func() bool {
+			return requestCount() >= failedRefreshes
+		}, 5*time.Second, 5*time.Millisecond)
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://issuer.example.com", jwk.Kid, privateKey, nil))
+		assert.NoError(t, err)
+	})
+
+	t.Run("stops refreshing removed issuers", func(t *testing.T) {
+		setKeys(jwk)
+		assert.NoError(t, tokenValidator.Reload(nil))
+		stoppedAt := requestCount()
+		assert.Never(t, func() bool {
+			// a refresh which was already running may still finish
+			return requestCount() > stoppedAt+1
+		}, 100*time.Millisecond, 10*time.Millisecond)
+	})
+}
+
+func TestTokenValidator_StaticKeySet(t *testing.T) {
+	privateKey, jwk := newTestKey(t, "key-id")
+	rotatedKey, rotatedJWK := newTestKey(t, "rotated-key-id")
+
+	document := func(jwk JWK) []byte {
+		document, err := json.Marshal(JWKSet{Keys: []JWK{jwk}})
+		if err != nil {
+			t.Fatalf("Error encoding jwks: %v", err)
+		}
+		return document
+	}
+
+	tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{
+		Issuer: "https://gitlab.internal.example.com",
+		Jwks:   document(jwk),
+	}}, auth.RefreshOptions{})
+	assert.NoError(t, err)
+
+	t.Run("passes valid token", func(t *testing.T) {
+		_, err := tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.internal.example.com", jwk.Kid, privateKey, nil))
+		assert.NoError(t, err)
+	})
+
+	t.Run("uses the new key set after reload", func(t *testing.T) {
+		err := tokenValidator.Reload([]auth.IssuerConfig{{
+			Issuer: "https://gitlab.internal.example.com",
+			Jwks:   document(rotatedJWK),
+		}})
+		assert.NoError(t, err)
+
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.internal.example.com", rotatedJWK.Kid, rotatedKey, nil))
+		assert.NoError(t, err)
+		_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signTestToken(t, "https://gitlab.internal.example.com", jwk.Kid, privateKey, nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("breaks on invalid key set", func(t *testing.T) {
+		_, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{
+			Issuer: "https://gitlab.internal.example.com",
+			Jwks:   []byte("{\"keys\": "),
+		}}, auth.RefreshOptions{})
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenValidator_AlgorithmAndKeyPinning(t *testing.T) {
+	privateKey, jwk := newTestKey(t, "key-id")
+	_, otherJWK := newTestKey(t, "other-key-id")
+
+	document, err := json.Marshal(JWKSet{Keys: []JWK{jwk, otherJWK}})
+	if err != nil {
+		t.Fatalf("Error encoding jwks: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": "https://issuer.example.com",
+		"sub": "1234567890",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = jwk.Kid
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	tests := map[string]struct {
+		Issuer auth.IssuerConfig
+		Error  string
+	}{
+		"01_allowed": {
+			Issuer: auth.IssuerConfig{AllowedAlgorithms: []string{"ES256", "RS256"}, AllowedKids: []string{"key-id"}},
+		},
+		"02_algorithm_not_allowed": {
+			Issuer: auth.IssuerConfig{AllowedAlgorithms: []string{"ES256", "EdDSA"}},
+			Error:  "signing algorithm \"RS256\" is not allowed",
+		},
+		"03_kid_not_allowed": {
+			Issuer: auth.IssuerConfig{AllowedKids: []string{"other-key-id"}},
+			Error:  "key id \"key-id\" is not allowed",
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			issuer := testCase.Issuer
+			issuer.Issuer = "https://issuer.example.com"
+			issuer.Jwks = document
+			tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{issuer}, auth.RefreshOptions{})
+			assert.NoError(t, err)
+
+			_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
+			if testCase.Error == "" {
+				assert.NoError(t, err)
+			} else if err == nil || !strings.Contains(err.Error(), testCase.Error) {
+				t.Errorf("Function returned unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("breaks on unsupported algorithm", func(t *testing.T) {
+		_, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{{
+			Issuer:            "https://issuer.example.com",
+			Jwks:              document,
+			AllowedAlgorithms: []string{"none"},
+		}}, auth.RefreshOptions{})
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenValidator_TimeClaims(t *testing.T) {
+	privateKey, jwk := newTestKey(t, "key-id")
+
+	document, err := json.Marshal(JWKSet{Keys: []JWK{jwk}})
+	if err != nil {
+		t.Fatalf("Error encoding jwks: %v", err)
+	}
+
+	now := time.Now()
+	tests := map[string]struct {
+		Claims jwt.MapClaims
+		Issuer auth.IssuerConfig
+		Error  string
+	}{
+		"01_no_time_claims": {
+			Claims: jwt.MapClaims{},
+		},
+		"02_missing_required_exp": {
+			Claims: jwt.MapClaims{"iat": now.Unix()},
+			Issuer: auth.IssuerConfig{RequireExpiration: true},
+			Error:  "no expiration time",
+		},
+		"03_missing_required_iat": {
+			Claims: jwt.MapClaims{"exp": now.Add(time.Hour).Unix()},
+			Issuer: auth.IssuerConfig{RequireIssuedAt: true},
+			Error:  "no issued at time",
+		},
+		"04_expired_within_leeway": {
+			Claims: jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()},
+			Issuer: auth.IssuerConfig{Leeway: 30},
+		},
+		"05_expired_beyond_leeway": {
+			Claims: jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()},
+			Issuer: auth.IssuerConfig{Leeway: 30},
+			Error:  "expired",
+		},
+		"06_not_valid_yet_within_leeway": {
+			Claims: jwt.MapClaims{"nbf": now.Add(10 * time.Second).Unix(), "iat": now.Add(10 * time.Second).Unix()},
+			Issuer: auth.IssuerConfig{Leeway: 30},
+		},
+		"07_not_valid_yet": {
+			Claims: jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()},
+			Error:  "not valid yet",
+		},
+		"08_young_enough": {
+			Claims: jwt.MapClaims{"iat": now.Add(-time.Minute).Unix(), "exp": now.Add(time.Hour).Unix()},
+			Issuer: auth.IssuerConfig{MaxTokenAge: 300},
+		},
+		"09_too_old": {
+			Claims: jwt.MapClaims{"iat": now.Add(-10 * time.Minute).Unix(), "exp": now.Add(time.Hour).Unix()},
+			Issuer: auth.IssuerConfig{MaxTokenAge: 300},
+			Error:  "older than the allowed 300 seconds",
+		},
+		"10_max_age_without_iat": {
+			Claims: jwt.MapClaims{"exp": now.Add(time.Hour).Unix()},
+			Issuer: auth.IssuerConfig{MaxTokenAge: 300},
+			Error:  "no issued at time",
+		},
+	}
+	for name, testCase := range tests {
+		t.Run(name, func(t *testing.T) {
+			issuer := testCase.Issuer
+			issuer.Issuer = "https://issuer.example.com"
+			issuer.Jwks = document
+			tokenValidator, err := auth.NewMultiIssuerTokenValidator([]auth.IssuerConfig{issuer}, auth.RefreshOptions{})
+			assert.NoError(t, err)
+
+			claims := jwt.MapClaims{"iss": "https://issuer.example.com", "sub": "1234567890"}
+			for claim, value := range testCase.Claims {
+				claims[claim] = value
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = jwk.Kid
+			signedToken, err := token.SignedString(privateKey)
+			if err != nil {
+				t.Fatalf("Error signing token: %v", err)
+			}
+
+			_, err = tokenValidator.RetrieveClaimsFromToken(context.TODO(), signedToken)
+			if testCase.Error == "" {
+				assert.NoError(t, err)
+			} else if err == nil || !strings.Contains(err.Error(), testCase.Error) {
+				t.Errorf("Function returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateClaimValues(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, auth.ValidateClaimValues([]byte("{\"ref\": [\"main\", {\"glob\": \"release/*\"}], \"project_path\": {\"regex\": \"^infra/\"}, \"nested\": {\"groups\": {\"contains_all\": [\"a\"]}}}")))
+	})
+
+	tests := map[string]string{
+		"01_invalid_regex":         "{\"ref\": {\"regex\": \"^(release\"}}",
+		"02_nested_invalid_regex":  "{\"foo\": {\"ref\": [{\"regex\": \"[\"}]}}",
+		"03_glob_without_string":   "{\"ref\": {\"glob\": 4}}",
+		"04_contains_all_no_array": "{\"groups\": {\"contains_all\": \"a\"}}",
+		"05_null_value":            "{\"ref\": null}",
+		"06_gt_without_number":     "{\"project_id\": {\"gt\": \"abc\"}}",
+		"07_between_single_value":  "{\"project_id\": {\"between\": [1]}}",
+		"08_between_reversed":      "{\"project_id\": {\"between\": [200, 100]}}",
+		"09_gt_infinity":           "{\"project_id\": {\"gt\": \"-Infinity\"}}",
+	}
+	for name, claimValues := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, auth.ValidateClaimValues([]byte(claimValues)))
+		})
+	}
+}
+
+func TestTokenValidator_ValidateClaimsForRule(t *testing.T) {
+	ctx := context.TODO()
+	claims := &auth.Claims{ClaimsJSON: []byte("{\"namespace_path\": \"AOEpeople\", \"project_path\": \"AOEpeople/fork\"}")}
+
+	rules := []auth.Rule{
+		{
+			Role:        "arn:aws:iam::012345678910:role/deploy",
+			ClaimValues: []byte("{\"namespace_path\": \"AOEpeople\"}"),
+		},
+		{
+			Role:        "arn:aws:iam::012345678910:role/read",
+			ClaimValues: []byte("{\"namespace_path\": \"AOEpeople\"}"),
+		},
+		{
+			Role:        "arn:aws:iam::012345678910:role/deploy",
+			Effect:      auth.EffectDeny,
+			ClaimValues: []byte("{\"project_path\": {\"glob\": \"*/fork\"}}"),
+		},
+		{
+			Effect:      auth.EffectDeny,
+			ClaimValues: []byte("{\"project_path\": \"AOEpeople/compromised\"}"),
+		},
+	}
+
+	t.Run("returns matching allow rule", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/read", rules)
+		assert.NoError(t, err)
+		assert.Equal(t, &rules[1], rule)
+	})
+
+	t.Run("returns nothing without matching rule", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/admin", rules)
+		assert.NoError(t, err)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("deny rule takes precedence", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/deploy", rules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("rule with coerce_types", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		claims := &auth.Claims{ClaimsJSON: []byte("{\"namespace_id\": \"4\"}")}
+		coerceTypes := true
+		coercingRules := []auth.Rule{
+			{Role: "arn:aws:iam::012345678910:role/strict", ClaimValues: []byte("{\"namespace_id\": 4}")},
+			{Role: "arn:aws:iam::012345678910:role/coerced", CoerceTypes: &coerceTypes, ClaimValues: []byte("{\"namespace_id\": 4}")},
+		}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/strict", coercingRules)
+		assert.NoError(t, err)
+		assert.Nil(t, rule)
+		rule, err = tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/coerced", coercingRules)
+		assert.NoError(t, err)
+		assert.Equal(t, &coercingRules[1], rule)
+	})
+
+	t.Run("deny rule without role applies to all roles", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		claims := &auth.Claims{ClaimsJSON: []byte("{\"namespace_path\": \"AOEpeople\", \"project_path\": \"AOEpeople/compromised\"}")}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/read", rules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("deny rule without claim values applies to all tokens", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		lockedRules := append([]auth.Rule{{Role: "arn:aws:iam::012345678910:role/read", Effect: auth.EffectDeny}}, rules...)
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/read", lockedRules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("deny rule which cannot be evaluated denies", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		brokenRules := append([]auth.Rule{{
+			Effect:      auth.EffectDeny,
+			ClaimValues: []byte("{\"project_path\": {\"contains_all\": \"AOEpeople/fork\"}}"),
+		}}, rules...)
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/read", brokenRules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("deny rule with unrenderable role denies", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		brokenRules := append([]auth.Rule{{
+			Role:   "arn:aws:iam::012345678910:role/${missing}",
+			Effect: auth.EffectDeny,
+		}}, rules...)
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/read", brokenRules)
+		assert.ErrorIs(t, err, auth.ErrAccessDenied)
+		assert.Nil(t, rule)
+	})
+
+	t.Run("allow rule without claim values matches nothing", func(t *testing.T) {
+		tokenValidator := auth.TokenValidator{}
+		openRules := []auth.Rule{{Role: "arn:aws:iam::012345678910:role/open"}}
+		rule, err := tokenValidator.ValidateClaimsForRule(ctx, claims, "arn:aws:iam::012345678910:role/open", openRules)
+		assert.NoError(t, err)
+		assert.Nil(t, rule)
+	})
+}
+
+func TestConfig_Validate_Issuers(t *testing.T) {
+	t.Run("issuers with issuer", func(t *testing.T) {
+		config := auth.Config{Issuers: []auth.IssuerConfig{{Issuer: "https://gitlab.example.com", JwksURL: "https://gitlab.example.com/-/jwks"}}}
+		assert.NoError(t, config.Validate())
+	})
+
+	t.Run("issuer without issuer", func(t *testing.T) {
+		config := auth.Config{Issuers: []auth.IssuerConfig{
+			{Issuer: "https://gitlab.example.com"},
+			{JwksURL: "https://keys.example.com/jwks"},
+		}}
+		assert.Error(t, config.Validate())
+	})
+
+	t.Run("single issuer settings without bound issuer", func(t *testing.T) {
+		config := auth.Config{JwksURL: "https://keys.example.com/jwks"}
+		assert.NoError(t, config.Validate())
+		assert.Equal(t, "", config.IssuerConfigs()[0].Issuer)
+	})
+}
+
+func TestConfig_ClaimTypeWarnings(t *testing.T) {
+	coerceTypes := true
+	config := auth.Config{
+		Issuers: []auth.IssuerConfig{
+			{Issuer: "https://gitlab.example.com"},
+			{Issuer: "https://sso.example.com", KnownClaimTypes: map[string]string{"department": auth.ClaimTypeNumber}},
+		},
+		Rules: []auth.Rule{
+			{Role: "arn:aws:iam::012345678910:role/ok", ClaimValues: []byte("{\"namespace_id\": \"4\", \"runner_id\": {\"gt\": 3}}")},
+			{Role: "arn:aws:iam::012345678910:role/number", ClaimValues: []byte("{\"namespace_id\": [\"4\", 5]}")},
+			{Role: "arn:aws:iam::012345678910:role/custom", ClaimValues: []byte("{\"department\": \"12\"}")},
+			{Role: "arn:aws:iam::012345678910:role/coerced", CoerceTypes: &coerceTypes, ClaimValues: []byte("{\"namespace_id\": 4}")},
+		},
+	}
+
+	warnings := config.ClaimTypeWarnings()
+	assert.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], "rule 1 (arn:aws:iam::012345678910:role/number) compares claim namespace_id")
+	assert.Contains(t, warnings[1], "rule 2 (arn:aws:iam::012345678910:role/custom) compares claim department")
+
+	config.CoerceTypes = true
+	assert.Empty(t, config.ClaimTypeWarnings())
+}